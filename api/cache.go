@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"go.jonnrb.io/piad/internal/atomicfile"
+)
+
+// How old a cached server list may be and still be used, unless
+// ServerListCacheMaxAge says otherwise. Servers come and go, so a list much
+// older than this is likely to lead nowhere.
+const DefaultServerListCacheMaxAge = 7 * 24 * time.Hour
+
+type cachedServerList struct {
+	FetchedAt time.Time `json:"fetched_at"`
+
+	// The response body as it was signed, so it can be verified again when
+	// it's loaded.
+	Body []byte `json:"body"`
+}
+
+func (c *Client) storeServerList(fetchedAt time.Time, body []byte) {
+	if c == nil || c.ServerListCachePath == "" {
+		return
+	}
+
+	b, err := json.Marshal(cachedServerList{
+		FetchedAt: fetchedAt,
+		Body:      body,
+	})
+	if err == nil {
+		err = atomicfile.WriteFile(c.ServerListCachePath, b, 0600)
+	}
+	if err != nil {
+		log.Printf("error caching server list: %v", err)
+	}
+}
+
+func (c *Client) loadServerList(now time.Time) (l ServerList, fetchedAt time.Time, err error) {
+	if c == nil || c.ServerListCachePath == "" {
+		err = errors.New("no server list cache")
+		return
+	}
+
+	b, err := ioutil.ReadFile(c.ServerListCachePath)
+	if err != nil {
+		return
+	}
+
+	var cl cachedServerList
+	err = json.Unmarshal(b, &cl)
+	if err != nil {
+		return
+	}
+
+	if now.Sub(cl.FetchedAt) > c.serverListCacheMaxAge() {
+		err = fmt.Errorf("cached server list from %v is too old", cl.FetchedAt)
+		return
+	}
+
+	l, err = c.parseServerList(cl.Body)
+	fetchedAt = cl.FetchedAt
+	return
+}
+
+func (c *Client) serverListCacheMaxAge() time.Duration {
+	if c != nil && c.ServerListCacheMaxAge != 0 {
+		return c.ServerListCacheMaxAge
+	}
+	return DefaultServerListCacheMaxAge
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServerListCache(t *testing.T) {
+	down := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintf(w, "%s\n\nc2ln\n", testServerList)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "piad-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &Client{
+		ServerListEndpoint:   srv.URL,
+		SkipServerListVerify: true,
+		ServerListCachePath:  filepath.Join(dir, "serverlist.json"),
+	}
+	ctx := context.Background()
+
+	_, err = c.GetServerList(ctx)
+	if err != nil {
+		t.Fatalf("GetServerList: %v", err)
+	}
+
+	down = true
+	l, err := c.GetServerList(ctx)
+	var stale *StaleError
+	if !errors.As(err, &stale) || !errors.Is(err, ErrServerUnavailable) {
+		t.Fatalf("got error %v with the server down, want a *StaleError wrapping ErrServerUnavailable", err)
+	}
+	if time.Since(stale.FetchedAt) > time.Minute {
+		t.Errorf("cached list is from %v", stale.FetchedAt)
+	}
+	if len(l.Regions) != 1 {
+		t.Errorf("got regions %+v from the cache", l.Regions)
+	}
+
+	c.ServerListCacheMaxAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	_, err = c.GetServerList(ctx)
+	if errors.As(err, &stale) || !errors.Is(err, ErrServerUnavailable) {
+		t.Errorf("got error %v with only an expired cache, want just ErrServerUnavailable", err)
+	}
+}
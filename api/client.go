@@ -0,0 +1,122 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Talks to PIA. The zero value (or nil) uses the real endpoints and the
+// default transport.
+type Client struct {
+	// Override the default endpoints (e.g. to point at a fake PIA).
+	ServerListEndpoint string
+	TokenEndpoint      string
+
+	// Template for the transport used for all requests, including those the
+	// session package makes to servers. Defaults to http.DefaultTransport.
+	Transport *http.Transport
+
+	// Limits how long each request may take. Zero means no limit.
+	Timeout time.Duration
+
+	// Accept server lists without a valid signature. This is ignored unless
+	// ServerListEndpoint points somewhere other than PIA.
+	SkipServerListVerify bool
+
+	// Where to keep the last good server list, if anywhere, and how old it
+	// may get before it's no longer used. The age defaults to
+	// DefaultServerListCacheMaxAge.
+	ServerListCachePath   string
+	ServerListCacheMaxAge time.Duration
+}
+
+// Returns a copy of c whose connections are made with dial.
+func (c *Client) WithDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *Client {
+	var cc Client
+	if c != nil {
+		cc = *c
+	}
+	cc.Transport = cc.transport()
+	cc.Transport.DialContext = dial
+	return &cc
+}
+
+// Returns a copy of c whose connections are made with dial, unless c's
+// transport already has its own way of dialing (e.g. to reach a fake PIA).
+func (c *Client) WithDefaultDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *Client {
+	if c != nil && c.Transport != nil && c.Transport.DialContext != nil {
+		cc := *c
+		return &cc
+	}
+	return c.WithDialContext(dial)
+}
+
+// Dials like the client's transport would.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c != nil && c.Transport != nil && c.Transport.DialContext != nil {
+		return c.Transport.DialContext(ctx, network, addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+// Returns an HTTP client for PIA's web APIs.
+func (c *Client) HTTPClient() *http.Client {
+	return c.httpClient(c.transport())
+}
+
+// Returns an HTTP client for a server presenting a cert for serverName. The
+// cert is checked against roots unless the transport specifies its own.
+func (c *Client) ServerHTTPClient(serverName string, roots *x509.CertPool) *http.Client {
+	t := c.transport()
+
+	cfg := &tls.Config{}
+	if t.TLSClientConfig != nil {
+		cfg = t.TLSClientConfig.Clone()
+	}
+	cfg.ServerName = serverName
+	if cfg.RootCAs == nil {
+		cfg.RootCAs = roots
+	}
+	t.TLSClientConfig = cfg
+
+	return c.httpClient(t)
+}
+
+func (c *Client) httpClient(t *http.Transport) *http.Client {
+	cli := &http.Client{Transport: t}
+	if c != nil {
+		cli.Timeout = c.Timeout
+	}
+	return cli
+}
+
+func (c *Client) transport() *http.Transport {
+	if c != nil && c.Transport != nil {
+		return c.Transport.Clone()
+	}
+	return http.DefaultTransport.(*http.Transport).Clone()
+}
+
+func (c *Client) serverListEndpoint() string {
+	if c != nil && c.ServerListEndpoint != "" {
+		return c.ServerListEndpoint
+	}
+	return ServerListEndpoint
+}
+
+func (c *Client) tokenEndpoint() string {
+	if c != nil && c.TokenEndpoint != "" {
+		return c.TokenEndpoint
+	}
+	return TokenEndpoint
+}
+
+func (c *Client) skipServerListVerify() bool {
+	return c != nil && c.SkipServerListVerify &&
+		c.serverListEndpoint() != ServerListEndpoint
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testServerList = `{"groups":{"wg":[{"name":"wireguard","ports":[1337]}]},"regions":[{"id":"us","dns":"us.example","port_forward":true,"servers":{"wg":[{"ip":"192.0.2.1","cn":"us1"}]}}]}`
+
+func TestGetServerList(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s\n\nbm90IGEgc2lnbmF0dXJl\n", testServerList)
+	}))
+	defer srv.Close()
+
+	c := &Client{ServerListEndpoint: srv.URL, SkipServerListVerify: true}
+	l, err := c.GetServerList(context.Background())
+	if err != nil {
+		t.Fatalf("GetServerList: %v", err)
+	}
+	if len(l.Regions) != 1 || !l.Regions[0].PortForward {
+		t.Fatalf("got regions %+v", l.Regions)
+	}
+	if ss := l.Regions[0].Servers["wg"]; len(ss) != 1 || ss[0].CommonName != "us1" {
+		t.Errorf("got wg servers %+v, want just us1", ss)
+	}
+}
+
+func TestGetServerListError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	c := &Client{ServerListEndpoint: srv.URL, SkipServerListVerify: true}
+	_, err := c.GetServerList(context.Background())
+	if !errors.Is(err, ErrServerUnavailable) {
+		t.Errorf("got error %v, want ErrServerUnavailable", err)
+	}
+}
+
+func TestGetToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req tokenRequest
+		if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if req.Username != "user" || req.Password != "pass" {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"token":"tok"}`)
+	}))
+	defer srv.Close()
+
+	c := &Client{TokenEndpoint: srv.URL}
+
+	tok, err := c.GetToken(context.Background(), "user", "pass")
+	if err != nil || tok != "tok" {
+		t.Errorf("GetToken = %q, %v; want \"tok\"", tok, err)
+	}
+
+	tok, err = c.GetToken(context.Background(), "user", "wrong")
+	if !errors.Is(err, ErrAuth) || tok != "" {
+		t.Errorf("GetToken with bad password = %q, %v; want ErrAuth", tok, err)
+	}
+}
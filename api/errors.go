@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Classes of API failures. Use errors.Is to check which one a *StatusError
+// falls into.
+var (
+	// The credentials or token were rejected. Retrying won't help.
+	ErrAuth = errors.New("authentication failed")
+
+	// Too many requests; back off (see StatusError.RetryAfter).
+	ErrRateLimited = errors.New("rate limited")
+
+	// The server had a problem that will probably go away.
+	ErrServerUnavailable = errors.New("server unavailable")
+
+	// The key being added is already registered with the server.
+	ErrKeyConflict = errors.New("key conflict")
+)
+
+// A non-OK response from one of PIA's APIs.
+type StatusError struct {
+	URL        string
+	StatusCode int
+
+	// The message in the response body, if there was one.
+	Message string
+
+	// How long the server asked us to wait before trying again, if it did.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("HTTP error %d from %s", e.StatusCode, e.URL)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrAuth:
+		return e.StatusCode == http.StatusUnauthorized ||
+			e.StatusCode == http.StatusForbidden
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrServerUnavailable:
+		return e.StatusCode >= 500
+	case ErrKeyConflict:
+		return e.StatusCode == http.StatusConflict
+	default:
+		return false
+	}
+}
+
+// Returns a *StatusError describing res unless it is a 200.
+func CheckResponse(res *http.Response) error {
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	e := &StatusError{
+		StatusCode: res.StatusCode,
+		Message:    readMessage(res.Body),
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+	}
+	if res.Request != nil {
+		u := *res.Request.URL
+		// Don't leak tokens and such into logs.
+		u.RawQuery = ""
+		e.URL = u.String()
+	}
+	return e
+}
+
+// Pulls a message out of an error body, which is usually JSON with a
+// "message" field but is sometimes just text.
+func readMessage(r io.Reader) string {
+	b, _ := ioutil.ReadAll(io.LimitReader(r, 4096))
+
+	var m struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(b, &m) == nil && m.Message != "" {
+		return m.Message
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
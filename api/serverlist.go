@@ -3,7 +3,10 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"time"
 )
 
 const ServerListEndpoint = "https://serverlist.piaservers.net/vpninfo/servers/v6"
@@ -34,18 +37,74 @@ type Server struct {
 	CommonName string `json:"cn"`
 }
 
-func GetServerList(ctx context.Context) (l ServerList, err error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", ServerListEndpoint, nil)
+// Fetches the server list. If ServerListCachePath is set, the list is cached
+// there, and if fetching it fails, the cached list is returned along with a
+// *StaleError.
+func (c *Client) GetServerList(ctx context.Context) (l ServerList, err error) {
+	now := time.Now()
+	b, err := c.fetchServerList(ctx)
+	if err == nil {
+		l, err = c.parseServerList(b)
+	}
+	if err == nil {
+		c.storeServerList(now, b)
+		return
+	}
+
+	cached, fetchedAt, cerr := c.loadServerList(now)
+	if cerr != nil {
+		return
+	}
+	return cached, &StaleError{FetchedAt: fetchedAt, Err: err}
+}
+
+// Returned with the cached server list when a fresh one couldn't be fetched.
+type StaleError struct {
+	FetchedAt time.Time
+	Err       error
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("using server list cached at %v: %v", e.FetchedAt, e.Err)
+}
+
+func (e *StaleError) Unwrap() error {
+	return e.Err
+}
+
+func (c *Client) fetchServerList(ctx context.Context) (b []byte, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.serverListEndpoint(), nil)
 	if err != nil {
 		return
 	}
 
-	res, err := (&http.Client{}).Do(req)
+	res, err := c.HTTPClient().Do(req)
 	if err != nil {
 		return
 	}
 	defer res.Body.Close()
 
-	err = json.NewDecoder(res.Body).Decode(&l)
+	err = CheckResponse(res)
+	if err != nil {
+		return
+	}
+
+	return ioutil.ReadAll(res.Body)
+}
+
+func (c *Client) parseServerList(b []byte) (l ServerList, err error) {
+	doc, sig, err := splitSigned(b)
+	if err != nil {
+		return
+	}
+
+	if !c.skipServerListVerify() {
+		err = verifySignature(serverListKey, doc, sig)
+		if err != nil {
+			return
+		}
+	}
+
+	err = json.Unmarshal(doc, &l)
 	return
 }
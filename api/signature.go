@@ -0,0 +1,91 @@
+package api
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+var serverListKey *rsa.PublicKey
+
+func init() {
+	b, _ := pem.Decode([]byte(`
+-----BEGIN PUBLIC KEY-----
+MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAzLYHwX5Ug/oUObZ5eH5P
+rEwmfj4E/YEfSKLgFSsyRGGsVmmjiXBmSbX2s3xbj/ofuvYtkMkP/VPFHy9E/8ox
+Y+cRjPzydxz46LPY7jpEw1NHZjOyTeUero5e1nkLhiQqO/cMVYmUnuVcuFfZyZvc
+8Apx5fBrIp2oWpF/G9tpUZfUUJaaHiXDtuYP8o8VhYtyjuUu3h7rkQFoMxvuoOFH
+6nkc0VQmBsHvCfq4T9v8gyiBtQRy543leapTBMT34mxVIQ4ReGLPVit/6sNLoGLb
+gSnGe9Bk/a5V/5vlqeemWF0hgoRtUxMtU1hFbe7e8tSq1j+mu0SHMyKHiHd+OsmU
+IQIDAQAB
+-----END PUBLIC KEY-----
+`))
+	if b == nil {
+		panic("failed to decode PIA server list key")
+	}
+
+	k, err := x509.ParsePKIXPublicKey(b.Bytes)
+	if err != nil {
+		panic(err)
+	}
+
+	var ok bool
+	serverListKey, ok = k.(*rsa.PublicKey)
+	if !ok {
+		panic("PIA server list key is not an RSA key")
+	}
+}
+
+// Returned when the server list's signature is missing or doesn't match.
+type SignatureError struct {
+	Err error
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("bad server list signature: %v", e.Err)
+}
+
+func (e *SignatureError) Unwrap() error {
+	return e.Err
+}
+
+// Splits a signed document (a JSON value followed by a base64 signature of it)
+// into the JSON and the signature.
+func splitSigned(b []byte) (doc, sig []byte, err error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	var raw json.RawMessage
+	err = dec.Decode(&raw)
+	if err != nil {
+		return
+	}
+
+	off := dec.InputOffset()
+	doc = b[:off]
+	sig = bytes.TrimSpace(b[off:])
+	return
+}
+
+func verifySignature(key *rsa.PublicKey, doc, sig []byte) error {
+	if len(sig) == 0 {
+		return &SignatureError{errors.New("missing signature")}
+	}
+
+	rawSig, err := base64.StdEncoding.DecodeString(string(sig))
+	if err != nil {
+		return &SignatureError{fmt.Errorf("error decoding signature: %w", err)}
+	}
+
+	h := sha256.Sum256(doc)
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], rawSig)
+	if err != nil {
+		return &SignatureError{err}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func sign(t *testing.T, key *rsa.PrivateKey, doc string) string {
+	h := sha256.Sum256([]byte(doc))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestVerifySignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		body string
+		ok   bool
+	}{
+		{"good", testServerList + "\n\n" + sign(t, key, testServerList) + "\n", true},
+		{"wrong key", testServerList + "\n\n" + sign(t, otherKey, testServerList) + "\n", false},
+		{"tampered", `{"groups":{},"regions":[]}` + "\n\n" + sign(t, key, testServerList) + "\n", false},
+		{"not base64", testServerList + "\n\n!!!\n", false},
+		{"missing", testServerList + "\n", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			doc, sig, err := splitSigned([]byte(c.body))
+			if err != nil {
+				t.Fatalf("splitSigned: %v", err)
+			}
+
+			err = verifySignature(&key.PublicKey, doc, sig)
+			var serr *SignatureError
+			switch {
+			case c.ok && err != nil:
+				t.Errorf("got %v, want no error", err)
+			case !c.ok && !errors.As(err, &serr):
+				t.Errorf("got %v, want a *SignatureError", err)
+			}
+		})
+	}
+}
+
+func TestSplitSigned(t *testing.T) {
+	doc, sig, err := splitSigned([]byte(testServerList + "\n\nc2ln\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(doc) != testServerList || string(sig) != "c2ln" {
+		t.Errorf("got %q and %q", doc, sig)
+	}
+
+	_, _, err = splitSigned([]byte("not json"))
+	if err == nil {
+		t.Error("got no error splitting garbage")
+	}
+}
+
+// The opt-out only applies to endpoints other than PIA's, and lists signed by
+// some other key are rejected.
+func TestGetServerListVerifies(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s\n\n%s\n", testServerList, sign(t, key, testServerList))
+	}))
+	defer srv.Close()
+
+	c := &Client{ServerListEndpoint: srv.URL}
+	_, err = c.GetServerList(context.Background())
+	var serr *SignatureError
+	if !errors.As(err, &serr) {
+		t.Errorf("got %v, want a *SignatureError", err)
+	}
+
+	c = &Client{SkipServerListVerify: true}
+	if c.skipServerListVerify() {
+		t.Error("SkipServerListVerify applies to PIA's endpoint")
+	}
+}
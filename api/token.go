@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 )
 
@@ -20,7 +21,7 @@ type tokenResponse struct {
 	Token Token `json:"token"`
 }
 
-func GetToken(ctx context.Context, username, password string) (Token, error) {
+func (c *Client) GetToken(ctx context.Context, username, password string) (Token, error) {
 	var buf bytes.Buffer
 	err := json.NewEncoder(&buf).Encode(tokenRequest{
 		Username: username,
@@ -30,19 +31,27 @@ func GetToken(ctx context.Context, username, password string) (Token, error) {
 		return "", err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", TokenEndpoint, &buf)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.tokenEndpoint(), &buf)
 	if err != nil {
 		return "", err
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	res, err := (&http.Client{}).Do(req)
+	res, err := c.HTTPClient().Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer res.Body.Close()
 
+	err = CheckResponse(res)
+	if err != nil {
+		return "", err
+	}
+
 	var tres tokenResponse
 	err = json.NewDecoder(res.Body).Decode(&tres)
+	if err == nil && tres.Token == "" {
+		err = errors.New("no token in response")
+	}
 	return tres.Token, err
 }
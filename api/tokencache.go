@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// How long PIA tokens are good for.
+	TokenLifetime = 24 * time.Hour
+
+	// Tokens are refreshed this long before they expire.
+	tokenRefreshMargin = 4 * time.Hour
+	tokenRetryDelay    = 5 * time.Minute
+)
+
+// Hands out tokens, only logging in again when the cached one is close to
+// expiring or has been rejected.
+type TokenCache struct {
+	Client   *Client
+	Username string
+	Password string
+
+	mu       sync.Mutex
+	tok      Token
+	issuedAt time.Time
+}
+
+func (tc *TokenCache) Token(ctx context.Context) (Token, error) {
+	tc.mu.Lock()
+	tok, issuedAt := tc.tok, tc.issuedAt
+	tc.mu.Unlock()
+
+	if tok != "" && time.Since(issuedAt) < TokenLifetime-tokenRefreshMargin {
+		return tok, nil
+	}
+	return tc.refresh(ctx)
+}
+
+// Drops tok from the cache (if it's still there) so the next call to Token
+// logs in again.
+func (tc *TokenCache) Invalidate(tok Token) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.tok == tok {
+		tc.tok = ""
+		tc.issuedAt = time.Time{}
+	}
+}
+
+// Refreshes the token ahead of its expiry until ctx is done so that one is
+// on hand even if the token service is having trouble when it's needed.
+func (tc *TokenCache) Run(ctx context.Context) {
+	for {
+		tc.mu.Lock()
+		d := TokenLifetime - tokenRefreshMargin - time.Since(tc.issuedAt)
+		if tc.tok == "" {
+			// Nothing to refresh yet, so just check again later.
+			d = tokenRetryDelay
+		}
+		tc.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d):
+		}
+
+		tc.mu.Lock()
+		due := tc.tok != "" && time.Since(tc.issuedAt) >= TokenLifetime-tokenRefreshMargin
+		tc.mu.Unlock()
+		if !due {
+			// Either there's no token (callers of Token log in on demand)
+			// or a fresh one turned up while we waited.
+			continue
+		}
+
+		_, err := tc.refresh(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("error refreshing token: %v", err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(tokenRetryDelay):
+			}
+		}
+	}
+}
+
+func (tc *TokenCache) refresh(ctx context.Context) (Token, error) {
+	now := time.Now()
+	tok, err := tc.Client.GetToken(ctx, tc.Username, tc.Password)
+	if err != nil {
+		return "", err
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.tok = tok
+	tc.issuedAt = now
+	return tok, nil
+}
@@ -0,0 +1,84 @@
+package piad
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"go.jonnrb.io/piad/api"
+	"go.jonnrb.io/piad/session"
+)
+
+// Picks regions by latency when used as the only entry in Controller.Regions.
+const AutoRegion = "auto"
+
+func (c Controller) isAuto() bool {
+	return len(c.Regions) == 1 && c.Regions[0] == AutoRegion
+}
+
+func (c Controller) regionFilter() session.RegionFilter {
+	return session.RegionFilter{
+		Countries:   c.Countries,
+		PortForward: c.PortForward,
+		Geo:         c.AllowGeo,
+	}
+}
+
+// Lists the regions that would be considered for AutoRegion. If probe is set,
+// they're ranked by latency, otherwise they're sorted by DNS name.
+func (c Controller) ListRegions(ctx context.Context, probe bool) ([]session.RegionProbe, error) {
+	// While our rules are up, probe over marked sockets so that we measure
+	// the path to the server rather than through the tunnel. Marking needs
+	// CAP_NET_ADMIN, so plain sockets are used otherwise.
+	cli := c.API
+	hasRules, err := c.LinkConfig.HasRules()
+	if err != nil {
+		return nil, fmt.Errorf("error checking for our rules: %w", err)
+	}
+	if hasRules {
+		cli = c.apiClient()
+	}
+
+	l, err := session.GetServers(ctx, cli)
+	var stale *api.StaleError
+	if errors.As(err, &stale) {
+		log.Printf("%v", err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if probe {
+		return l.Probe(ctx, cli, c.regionFilter()), nil
+	}
+
+	var ps []session.RegionProbe
+	f := c.regionFilter()
+	for _, r := range l {
+		if f.Match(r) {
+			ps = append(ps, session.RegionProbe{Region: r})
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].Region.DNS < ps[j].Region.DNS
+	})
+	return ps, nil
+}
+
+// Ranks the reachable regions by latency for use as a fallback list.
+func (c Controller) autoRegions(ctx context.Context, cli *api.Client, l session.ServerList) ([]string, error) {
+	var rs []string
+	for _, p := range l.Probe(ctx, cli, c.regionFilter()) {
+		if p.Err != nil {
+			continue
+		}
+		rs = append(rs, p.Region.DNS)
+	}
+	if len(rs) == 0 {
+		return nil, errors.New("no regions could be reached")
+	}
+
+	log.Printf("picked region %q automatically (%d candidates)", rs[0], len(rs))
+	return rs, nil
+}
@@ -3,28 +3,138 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"go.jonnrb.io/piad"
+	"go.jonnrb.io/piad/api"
+	"go.jonnrb.io/piad/link"
 )
 
 func main() {
-	c := piad.Controller{}
-	var d time.Duration
+	c := piad.Controller{API: &api.Client{}}
+	var (
+		d         time.Duration
+		regions   string
+		countries string
+		dnsMode   string
+		steerSrcs string
+		steerUIDs string
+		include   string
+		exclude   string
+	)
 
 	flag.StringVar(&c.LinkName, "linkName", "", "Name to give Wireguard link")
 	flag.StringVar(&c.Username, "username", "", "PIA username")
 	flag.StringVar(&c.Password, "password", "", "PIA password")
-	flag.StringVar(&c.RegionDNS, "server", "",
-		"DNS of server region (e.g. us-newyorkcity.privacy.network)")
+	flag.IntVar(&c.LinkConfig.FwMark, "fwMark", link.DefaultFwMark,
+		"Firewall mark for the tunnel's own traffic")
+	flag.IntVar(&c.LinkConfig.Table, "table", 0,
+		"Routing table to use (defaults to -fwMark)")
+	flag.IntVar(&c.LinkConfig.ExemptTable, "exemptTable", 0,
+		"Table whose non-default routes bypass the tunnel (defaults to main)")
+	flag.IntVar(&c.LinkConfig.SteerMark, "steerMark", 0,
+		"Only tunnel traffic with this fwmark (e.g. to run several tunnels)")
+	flag.StringVar(&steerSrcs, "steerSources", "",
+		"Only tunnel traffic from these comma-separated CIDRs")
+	flag.StringVar(&steerUIDs, "steerUIDs", "",
+		"Only tunnel traffic from these comma-separated UIDs or UID ranges "+
+			"(e.g. 1000-1999)")
+	flag.StringVar(&include, "include", "",
+		"Only send these comma-separated CIDRs through the tunnel")
+	flag.StringVar(&exclude, "exclude", "",
+		"Keep these comma-separated CIDRs (e.g. the LAN) out of the tunnel")
+	flag.BoolVar(&c.LinkConfig.Gateway, "gateway", false,
+		"Enable IP forwarding and masquerade traffic leaving the tunnel (e.g. "+
+			"for LAN clients steered in with -steerSources)")
+	flag.StringVar(&c.LinkConfig.Netns, "netns", "",
+		"Move the Wireguard link into this netns, given by name or path (e.g. "+
+			"/proc/<pid>/ns/net), where it is the only route, instead of using "+
+			"policy routing")
+	flag.IntVar(&c.LinkConfig.DNSGuardPriority, "dnsGuardPriority", 0,
+		"Priority of the -dnsGuard rule (0 lets the kernel pick)")
+	flag.IntVar(&c.LinkConfig.ExemptionPriority, "exemptionPriority", 0,
+		"Priority of the rule for -exemptTable (0 lets the kernel pick)")
+	flag.IntVar(&c.LinkConfig.BlackholePriority, "blackholePriority", 0,
+		"Priority of the rule sending traffic to -table (0 lets the kernel pick)")
+	flag.StringVar(&regions, "server", "",
+		"DNS of server region (e.g. us-newyorkcity.privacy.network), a "+
+			"comma-separated list of regions to fall back to in order, or "+
+			"\"auto\" to pick by latency")
+	flag.StringVar(&countries, "country", "",
+		"Comma-separated countries (e.g. US,CA) to consider with -server auto")
+	flag.BoolVar(&c.AllowGeo, "allowGeo", false,
+		"Consider geolocated regions with -server auto")
+	flag.DurationVar(&c.RegionRetryInterval, "regionRetryInterval",
+		piad.DefaultRegionRetryInterval,
+		"How often to try returning to a more preferred region")
+	flag.DurationVar(&c.API.Timeout, "apiTimeout", 30*time.Second,
+		"Timeout for requests to PIA")
+	flag.StringVar(&c.StateDir, "stateDir", "",
+		"Directory to keep state in across restarts")
+	flag.BoolVar(&c.KillSwitch, "killSwitch", false,
+		"Keep blocking traffic after exiting (undo with \"piad down --release\")")
+	flag.StringVar(&dnsMode, "dns", "",
+		"Point resolv.conf at PIA's DNS servers: \"system\" rewrites "+
+			"/etc/resolv.conf (or /etc/netns/<name>/resolv.conf with -netns), "+
+			"\"file\" writes -dnsFile")
+	flag.StringVar(&c.DNSFile, "dnsFile", "",
+		"Where to write a resolv.conf with -dns file")
+	flag.StringVar(&c.DNSListenAddr, "dnsListenAddr", "",
+		"Serve DNS here (e.g. 127.0.0.53:53), forwarding to PIA's DNS servers "+
+			"through the tunnel")
+	flag.BoolVar(&c.DNSGuard, "dnsGuard", false,
+		"Force all DNS traffic (port 53), even if marked, through the tunnel")
+	flag.DurationVar(&c.KeyRotationInterval, "keyRotationInterval", 0,
+		"How often to rotate the Wireguard key (e.g. 24h); 0 disables rotation")
+	flag.StringVar(&c.StatusAddr, "statusAddr", "",
+		"Address to serve status on (e.g. 127.0.0.1:8080)")
+	flag.BoolVar(&c.KeepLinkOnExit, "keepLinkOnExit", false,
+		"Leave the link up on exit so the next run can adopt it (needs -stateDir)")
+	flag.BoolVar(&c.PortForward, "portForward", false,
+		"Request a forwarded port (the region must support it)")
+	flag.StringVar(&c.PortFile, "portFile", "",
+		"File to write the forwarded port to")
 	flag.DurationVar(&d, "duration", 0,
 		"How long to run the VPN for (this is for debugging)")
 
 	flag.Parse()
 
+	if regions != "" {
+		c.Regions = splitList(regions)
+	}
+	if countries != "" {
+		c.Countries = splitList(countries)
+	}
+	c.DNSMode = piad.DNSMode(dnsMode)
+	c.LinkConfig.SteerSources = parseCIDRs("steerSources", steerSrcs)
+	c.LinkConfig.SteerUIDs = parseUIDRanges(steerUIDs)
+	c.LinkConfig.IncludePrefixes = parseCIDRs("include", include)
+	c.LinkConfig.ExcludePrefixes = parseCIDRs("exclude", exclude)
+
+	switch flag.Arg(0) {
+	case "":
+	case "down":
+		down(c, flag.Args()[1:])
+		return
+	case "regions":
+		listRegions(c, flag.Args()[1:])
+		return
+	case "exec":
+		execIn(c, flag.Args()[1:])
+		return
+	default:
+		log.Fatalf("unknown command %q", flag.Arg(0))
+	}
+
 	ctx, cancel := getCtx(d)
 	defer cancel()
 
@@ -34,11 +144,123 @@ func main() {
 	}
 }
 
+// Splits a comma-separated flag, ignoring spaces around the entries.
+func splitList(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+func parseCIDRs(flagName, s string) []net.IPNet {
+	if s == "" {
+		return nil
+	}
+	var ns []net.IPNet
+	for _, cidr := range splitList(s) {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatalf("bad -%s: %v", flagName, err)
+		}
+		ns = append(ns, *n)
+	}
+	return ns
+}
+
+func parseUIDRanges(s string) []link.UIDRange {
+	if s == "" {
+		return nil
+	}
+	var rs []link.UIDRange
+	for _, r := range splitList(s) {
+		bounds := strings.SplitN(r, "-", 2)
+		start, err := strconv.ParseUint(bounds[0], 10, 32)
+		if err != nil {
+			log.Fatalf("bad -steerUIDs: %v", err)
+		}
+		end := start
+		if len(bounds) == 2 {
+			end, err = strconv.ParseUint(bounds[1], 10, 32)
+			if err != nil {
+				log.Fatalf("bad -steerUIDs: %v", err)
+			}
+		}
+		rs = append(rs, link.UIDRange{Start: uint32(start), End: uint32(end)})
+	}
+	return rs
+}
+
+func down(c piad.Controller, args []string) {
+	fs := flag.NewFlagSet("down", flag.ExitOnError)
+	release := fs.Bool("release", false,
+		"Remove the kill switch too, letting traffic out unprotected")
+	fs.Parse(args)
+
+	err := c.Down(*release)
+	if err != nil {
+		log.Fatalf("error taking down link: %v", err)
+	}
+}
+
+func listRegions(c piad.Controller, args []string) {
+	fs := flag.NewFlagSet("regions", flag.ExitOnError)
+	probe := fs.Bool("probe", false, "Rank the regions by latency")
+	fs.Parse(args)
+
+	ctx, cancel := getCtx(0)
+	defer cancel()
+
+	ps, err := c.ListRegions(ctx, *probe)
+	if err != nil {
+		log.Fatalf("error listing regions: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "REGION\tCOUNTRY\tNAME\tPORT FORWARD\tGEO\tLATENCY")
+	for _, p := range ps {
+		var latency string
+		switch {
+		case !*probe:
+		case p.Err != nil:
+			latency = "unreachable"
+		default:
+			latency = p.Latency.Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%v\t%s\n",
+			p.Region.DNS, p.Region.Country, p.Region.Name,
+			p.Region.PortForward, p.Region.Geo, latency)
+	}
+	w.Flush()
+}
+
+func execIn(c piad.Controller, args []string) {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: piad -netns <name> -statusAddr <addr> exec -- <cmd> [args...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := getCtx(10 * time.Second)
+	defer cancel()
+
+	// Only returns on failure.
+	err := c.Exec(ctx, fs.Args())
+	log.Fatalf("error running %q: %v", fs.Arg(0), err)
+}
+
 func getCtx(d time.Duration) (context.Context, func()) {
 	ctx, cancel := newCtx(d)
 
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		defer signal.Stop(c)
 		select {
@@ -5,30 +5,136 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"net/http"
+	"os"
+	"path/filepath"
 	"time"
 
+	"go.jonnrb.io/piad/api"
+	"go.jonnrb.io/piad/dns"
 	"go.jonnrb.io/piad/link"
 	"go.jonnrb.io/piad/session"
 )
 
 type Controller struct {
-	LinkName  string
-	RegionDNS string
-	Username  string
-	Password  string
+	LinkName string
+	Username string
+	Password string
+
+	// The mark, table and rule priorities to use for policy routing.
+	LinkConfig link.Config
+
+	// DNS names of the regions to use, most preferred first. Later regions
+	// are only used when every server in the earlier ones has failed. If
+	// every server in every region has, the controller waits for one to come
+	// off its penalty and tries again rather than exiting.
+	//
+	// If this is just AutoRegion, the regions are ranked by latency instead,
+	// considering only those in Countries (if set) and, unless AllowGeo is
+	// set, not geolocated ones.
+	Regions   []string
+	Countries []string
+	AllowGeo  bool
+
+	// How often to try going back to a more preferred region while using a
+	// fallback one. Defaults to DefaultRegionRetryInterval.
+	RegionRetryInterval time.Duration
+
+	// Used to talk to PIA. If nil, the real endpoints are used.
+	API *api.Client
+
+	// Directory to keep state in across restarts (e.g. the last good server
+	// list, which is used when fetching it fails). Nothing is kept if empty.
+	// Each tunnel needs its own.
+	StateDir string
+
+	// If set, exiting leaves the rules in place with a blackhole route in our
+	// table instead of tearing everything down, so traffic doesn't leak while
+	// piad isn't running. Use Down(true) to actually release it.
+	KillSwitch bool
+
+	// Whether (and how) to point resolv.conf at the session's DNS servers.
+	DNSMode DNSMode
+	DNSFile string
+
+	// If set, serves DNS here by forwarding queries to the session's DNS
+	// servers through the tunnel.
+	DNSListenAddr string
+
+	// Force all DNS traffic (even marked) into the tunnel. While the tunnel is
+	// down piad can't resolve names either, so it leans on its caches.
+	DNSGuard bool
+
+	// How often to replace the key with a new one. Zero disables rotation.
+	KeyRotationInterval time.Duration
+
+	// Address to serve the controller's Status on (as JSON at /status).
+	StatusAddr string
+
+	// If set, exiting leaves the link exactly as it is so that the next run
+	// (e.g. after an upgrade) can adopt it without interrupting traffic. This
+	// needs StateDir.
+	KeepLinkOnExit bool
+
+	// Keeps a forwarded port bound and writes it to PortFile (if set). Only
+	// works in regions that support port forwarding.
+	PortForward bool
+	PortFile    string
 }
 
 func (c Controller) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	s, err := c.start(ctx)
 	if err != nil {
 		return err
 	}
-	defer s.l.Close()
+	defer s.close()
+
+	go s.tokens.Run(ctx)
+
+	err = s.serveStatus(ctx)
+	if err != nil {
+		return fmt.Errorf("could not serve status: %w", err)
+	}
+
+	err = s.serveDNS(ctx)
+	if err != nil {
+		return fmt.Errorf("could not serve DNS: %w", err)
+	}
 
 	return s.runAddKeyLoop(ctx)
 }
 
+// Takes down the link of a controller that isn't running. Unless release is
+// set, the kill switch is left blocking traffic.
+func (c Controller) Down(release bool) error {
+	l := link.Link(c.linkName())
+	if release {
+		return l.Close(c.LinkConfig)
+	}
+	return l.CloseAndBlock(c.LinkConfig)
+}
+
+func (c Controller) linkName() string {
+	if c.LinkName == "" {
+		return "wg0"
+	}
+	return c.LinkName
+}
+
+// Talks to PIA over marked sockets so that API calls keep working when the
+// tunnel is down but our rules are still in place. A dialer set on API's
+// transport is used as-is instead.
+func (c Controller) apiClient() *api.Client {
+	d := link.Dialer(c.LinkConfig, c.outsideNameservers)
+	cli := c.API.WithDefaultDialContext(d.DialContext)
+	if c.StateDir != "" {
+		cli.ServerListCachePath = filepath.Join(c.StateDir, serverListCacheFile)
+	}
+	return cli
+}
+
 func (c Controller) redact() Controller {
 	if c.Username != "" {
 		c.Username = "****"
@@ -40,74 +146,242 @@ func (c Controller) redact() Controller {
 }
 
 type controllerState struct {
-	ctlr Controller
-	l    link.Link
-	pk   session.PublicKey
-	srv  session.Server
-	sn   session.Session
-
-	isRefresh     bool
+	ctlr   Controller
+	l      link.Link
+	cli    *api.Client
+	tokens *api.TokenCache
+	sk     session.SecretKey
+	pk     session.PublicKey
+	status *statusHolder
+	fwd    *dns.Forwarder
+	srv    session.Server
+	sn     session.Session
+
+	// For the APIs only reachable through the tunnel.
+	tunnelCli *api.Client
+
+	serverList      session.ServerList
+	regionIdx       int
+	region          session.Region
+	failures        map[string]*serverFailures
+	nextRegionRetry time.Time
+
+	returningToRegion bool
+	regionReturns     chan regionReturn
+
+	serverListUpdates     chan serverListUpdate
+	nextServerListRefresh time.Time
+
+	isRefresh bool
+
+	// When the watchdog last saw (or, right after connecting, assumed) a
+	// handshake.
 	lastHandshake time.Time
+
+	// The device's last handshake with the current server, which is zero
+	// until the first one. Health is judged by this rather than by the
+	// watchdog's assumption.
+	handshake time.Time
+
+	// Set when the link from a previous run was adopted, so there's no need
+	// to add the key.
+	resumed bool
+
+	keyCreatedAt           time.Time
+	keyRotated             bool
+	nextKeyRotationAttempt time.Time
+
+	pf *session.PortForward
+	// Whether pf has been bound and written to PortFile by this run. A port
+	// from a previous run or one that failed its first bind isn't yet.
+	pfPublished        bool
+	nextPortForward    time.Time
+	bindingPort        bool
+	portForwardUpdates chan portForwardUpdate
 }
 
 func (c Controller) start(ctx context.Context) (s controllerState, err error) {
-	if c.RegionDNS == "" || c.Username == "" || c.Password == "" {
+	if len(c.Regions) == 0 || c.Username == "" || c.Password == "" ||
+		(c.KeepLinkOnExit && c.StateDir == "") {
 		err = fmt.Errorf("invalid controller: %+v", c.redact())
 		return
 	}
-	if c.LinkName == "" {
-		c.LinkName = "wg0"
+	if _, _, err = c.resolvConf(); err != nil {
+		return
 	}
+	c.LinkName = c.linkName()
 	s.ctlr = c
+	s.status = &statusHolder{}
+	s.fwd = &dns.Forwarder{Dial: link.Link(c.LinkName).DialFunc(c.LinkConfig)}
+
+	if c.StateDir != "" {
+		err = os.MkdirAll(c.StateDir, 0700)
+		if err != nil {
+			err = fmt.Errorf("could not create state dir: %w", err)
+			return
+		}
+	}
+	err = c.LinkConfig.CheckConflicts()
+	if err != nil {
+		err = fmt.Errorf("bad link config: %w", err)
+		return
+	}
+
+	// A guard left by a previous run would block the lookups below.
+	err = link.FlushDNSGuard(c.LinkConfig)
+	if err != nil {
+		err = fmt.Errorf("could not remove DNS guard: %w", err)
+		return
+	}
+
+	s.cli = c.apiClient()
+	s.tunnelCli = c.API.WithDialContext(link.Link(c.LinkName).DialFunc(c.LinkConfig))
+	s.tokens = &api.TokenCache{
+		Client:   s.cli,
+		Username: c.Username,
+		Password: c.Password,
+	}
 
-	s.srv, err = c.getServer(ctx)
+	s.nextServerListRefresh = time.Now().Add(serverListRefreshInterval)
+	s.serverList, err = session.GetServers(ctx, s.cli)
+	var stale *api.StaleError
+	if errors.As(err, &stale) {
+		// Good enough to start with, but try for a fresh one soon.
+		log.Printf("%v", err)
+		s.nextServerListRefresh = time.Now().Add(serverListRetryDelay)
+		err = nil
+	}
 	if err != nil {
 		return
 	}
+	s.serverListUpdates = make(chan serverListUpdate, 1)
+	s.portForwardUpdates = make(chan portForwardUpdate, 1)
+	s.regionReturns = make(chan regionReturn, 1)
+	s.failures = make(map[string]*serverFailures)
+
+	if c.isAuto() {
+		s.ctlr.Regions, err = c.autoRegions(ctx, s.cli, s.serverList)
+		if err != nil {
+			return
+		}
+	}
 
-	sk, err := session.NewKey()
+	err = s.useFirstUsableRegion()
 	if err != nil {
-		err = fmt.Errorf("could not generate session secret key: %w", err)
 		return
 	}
-	s.pk = sk.PublicKey()
 
 	s.l = link.Link(c.LinkName)
 
-	err = s.l.Start(sk)
+	ps, ok, err := c.loadState()
+	if err != nil {
+		log.Printf("ignoring state from last run: %v", err)
+	}
+	if ok {
+		err = s.restoreState(ps)
+		if err != nil {
+			return
+		}
+	} else {
+		s.sk, err = session.NewKey()
+		if err != nil {
+			err = fmt.Errorf("could not generate session secret key: %w", err)
+			return
+		}
+		s.pk = s.sk.PublicKey()
+		s.keyCreatedAt = time.Now()
+	}
+
+	if s.resumed {
+		return
+	}
+	err = s.l.Start(s.ctlr.LinkConfig, s.sk)
 	if err != nil {
 		err = fmt.Errorf("could not bring up interface %q: %w", c.LinkName, err)
 	}
 	return
 }
 
+func (s *controllerState) close() {
+	if s.ctlr.KeepLinkOnExit {
+		log.Printf("leaving link %q up for the next run", string(s.l))
+		s.saveState()
+		return
+	}
+
+	var err error
+	if s.ctlr.KillSwitch {
+		err = s.l.CloseAndBlock(s.ctlr.LinkConfig)
+	} else {
+		err = s.l.Close(s.ctlr.LinkConfig)
+	}
+	if err != nil {
+		log.Printf("error closing link %q: %v", string(s.l), err)
+	}
+
+	s.restoreDNS()
+	s.unpublishPort()
+}
+
 func (s *controllerState) runAddKeyLoop(ctx context.Context) error {
 	// Assume connecting is as good as a handshake since there isn't a great
 	// timestamp to use until the first handshake.
-	s.lastHandshake = time.Now()
+	if !s.resumed {
+		s.lastHandshake = time.Now()
+	}
 
 	for {
 		err := s.addKeyOnceAndSyncLoop(ctx)
 
+		var tokErr *session.TokenError
 		switch {
 		case err == nil:
 			continue
 		case errors.Is(err, errNeedsReAdd):
 			continue
+		case errors.Is(err, errServerFailed):
+			log.Printf("%v; trying another server", err)
+			err = s.failover(ctx)
+			if err != nil {
+				return err
+			}
+		case errors.Is(err, api.ErrAuth) || ctx.Err() != nil:
+			return err
+		case errors.As(err, &tokErr):
+			// The server may be fine; wait for PIA's login to come back.
+			log.Printf("%v; trying again in %v", err, tokenRetryDelay)
+			select {
+			case <-time.After(tokenRetryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		default:
 			return err
 		}
 	}
 }
 
+// Routes and rules are deliberately left alone while re-adding so that the
+// link fails closed; the next sync fixes them up for the new session.
 func (s *controllerState) addKeyOnceAndSyncLoop(ctx context.Context) error {
-	defer s.l.Stop()
-
-	err := s.addKey(ctx)
-	if err != nil {
-		return fmt.Errorf(
-			"error adding key to server in region %q: %w",
-			s.ctlr.RegionDNS, err)
+	if s.resumed {
+		s.resumed = false
+	} else {
+		err := s.addKey(ctx)
+		var tokErr *session.TokenError
+		if err != nil && ctx.Err() == nil && !errors.Is(err, api.ErrAuth) &&
+			!errors.As(err, &tokErr) {
+			// Bad credentials and trouble logging in aren't the server's
+			// fault, but anything else from its /addKey is reason enough to
+			// try another one.
+			err = fmt.Errorf("%w: %v", errServerFailed, err)
+		}
+		if err != nil {
+			return fmt.Errorf(
+				"error adding key to server %q in region %q: %w",
+				s.srv.CommonName, s.region.DNS, err)
+		}
+		s.saveState()
 	}
 
 	// After this, we're refreshing the key on errors.
@@ -118,6 +392,11 @@ func (s *controllerState) addKeyOnceAndSyncLoop(ctx context.Context) error {
 
 func (s *controllerState) syncLoop(ctx context.Context) error {
 	for {
+		s.refreshServerList(ctx)
+		s.maybeReturnToPreferredRegion(ctx)
+		s.maybeRotateKey(ctx)
+		s.publishStatus()
+
 		err := s.syncAndWatchOnce(ctx)
 		if err != nil {
 			return err
@@ -125,12 +404,15 @@ func (s *controllerState) syncLoop(ctx context.Context) error {
 	}
 }
 
+// How long to wait before adding the key again when getting a token failed.
+const tokenRetryDelay = time.Minute
+
 // Can be returned from deep within the bowels of the controller to trigger a
 // re-add to PIA.
 var errNeedsReAdd = errors.New("needs re-add")
 
 func (s *controllerState) syncAndWatchOnce(ctx context.Context) error {
-	did, err := s.l.Sync(s.sn)
+	did, err := s.l.Sync(s.ctlr.LinkConfig, s.sn)
 	if err != nil {
 		log.Printf("session failed to sync: %+v", s.sn)
 		return fmt.Errorf("failed to sync dev %q: %w", string(s.l), err)
@@ -139,26 +421,39 @@ func (s *controllerState) syncAndWatchOnce(ctx context.Context) error {
 		log.Printf("synced device %q", string(s.l))
 	}
 
+	err = s.syncDNSGuard()
+	if err != nil {
+		return err
+	}
+	s.syncDNS()
+	s.syncPortForward(ctx)
+
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	case <-time.After(link.KeepaliveInterval):
-		t, err := s.l.LastHandshake()
+		t, err := s.l.LastHandshake(s.ctlr.LinkConfig)
 		now := time.Now()
 
 		switch {
 		case err == link.ErrNeedsSync:
 			log.Printf("couldn't find last handshake time: %v", err)
 			return nil
-		case err == nil:
+		case err == nil && t.After(s.lastHandshake):
+			// A handshake since the key was added means the server works.
 			s.lastHandshake = t
+			s.clearFailures(s.srv)
+			fallthrough
+		case err == nil:
+			s.handshake = t
 		}
 
 		ago := now.Sub(s.lastHandshake)
 		switch {
 		case s.keepaliveIntervalsPastHandshakeInterval(10, now):
 			return fmt.Errorf(
-				"last handshake was %v ago; assuming the server is dead", ago)
+				"%w: last handshake was %v ago; assuming the server is dead",
+				errServerFailed, ago)
 		case s.keepaliveIntervalsPastHandshakeInterval(5, now):
 			log.Printf("last handshake was %v ago; readding key to server", ago)
 			return errNeedsReAdd
@@ -172,54 +467,57 @@ func (s *controllerState) syncAndWatchOnce(ctx context.Context) error {
 }
 
 func (s *controllerState) keepaliveIntervalsPastHandshakeInterval(n int, now time.Time) bool {
+	return keepaliveIntervalsPastHandshakeInterval(s.lastHandshake, n, now)
+}
+
+func keepaliveIntervalsPastHandshakeInterval(lastHandshake time.Time, n int, now time.Time) bool {
 	const handshakeInterval = 120 * time.Second
 
 	d := handshakeInterval + time.Duration(n)*link.KeepaliveInterval
-	return s.lastHandshake.Add(d).Before(now)
+	return lastHandshake.Add(d).Before(now)
 }
 
-func (c Controller) getServer(ctx context.Context) (s session.Server, err error) {
-	defer func() {
-		if err != nil {
-			err = fmt.Errorf("error getting server for %q: %w", c.RegionDNS, err)
-		}
-	}()
-
-	rm, err := session.GetServers(ctx)
-	if err != nil {
+// Looks up a region, making sure it can be used with c.
+func (c Controller) usableRegion(rm session.ServerList, dns string) (r session.Region, err error) {
+	r, ok := rm[dns]
+	if !ok || len(r.Servers) == 0 {
+		err = fmt.Errorf("no servers for region %q", dns)
 		return
 	}
-
-	ss := rm[c.RegionDNS]
-	if len(ss) == 0 {
-		err = fmt.Errorf("no servers for region %q", c.RegionDNS)
+	if c.PortForward && !r.PortForward {
+		err = fmt.Errorf("region %q does not support port forwarding", dns)
 		return
 	}
-
-	// Just grab the first one. We could do something more complex, but in
-	// practice there's only ever one server.
-	s = ss[0]
 	return
 }
 
 func (s *controllerState) addKey(ctx context.Context) (err error) {
 	N := 5
-	prev := s.sn
 	for i := 0; i < N; i++ {
-		s.sn, err = s.srv.AddKey(ctx, s.ctlr.Username, s.ctlr.Password, s.pk)
+		var sn session.Session
+		sn, err = s.srv.AddKey(ctx, s.cli, s.tokens, s.pk)
 		if err == nil {
+			if !sn.ServerVIP.Equal(s.sn.ServerVIP) {
+				// Forwarded ports are tied to the server.
+				s.pf = nil
+				s.nextPortForward = time.Time{}
+			}
+			s.sn = sn
 			return
 		}
 
-		if s.isRefresh && errors.Is(err, session.StatusError(http.StatusConflict)) {
+		switch {
+		case s.isRefresh && errors.Is(err, api.ErrKeyConflict):
 			// If we're only trying to refresh the key, a "conflict" error
 			// implies the key already exists.
 			log.Printf("adding key after dead connection; key exists")
-			s.sn = prev
 			return nil
+		case errors.Is(err, api.ErrAuth):
+			// Retrying won't fix bad credentials.
+			return
 		}
 
-		backoff := (1 << i) * 25 * time.Millisecond
+		backoff := addKeyBackoff(err, i)
 		log.Printf("got error %v; doing %v backoff %d/%d", err, backoff, i+1, N)
 
 		select {
@@ -232,3 +530,24 @@ func (s *controllerState) addKey(ctx context.Context) (err error) {
 
 	return
 }
+
+// PIA asking us to slow down gets a longer backoff than a network hiccup, and
+// any Retry-After it sends is honored (within reason).
+func addKeyBackoff(err error, i int) time.Duration {
+	const maxRetryAfter = 5 * time.Minute
+
+	base := 25 * time.Millisecond
+	if errors.Is(err, api.ErrRateLimited) || errors.Is(err, api.ErrServerUnavailable) {
+		base = time.Second
+	}
+	backoff := (1 << i) * base
+
+	var serr *api.StatusError
+	if errors.As(err, &serr) && serr.RetryAfter > backoff {
+		backoff = serr.RetryAfter
+		if backoff > maxRetryAfter {
+			backoff = maxRetryAfter
+		}
+	}
+	return backoff
+}
@@ -0,0 +1,25 @@
+package piad
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+
+	"go.jonnrb.io/piad/api"
+)
+
+func TestAPIClientKeepsDialer(t *testing.T) {
+	errFake := errors.New("fake dialer")
+	c := Controller{API: &api.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, errFake
+		},
+	}}}
+
+	_, err := c.apiClient().DialContext(context.Background(), "tcp", "192.0.2.1:443")
+	if err != errFake {
+		t.Errorf("got %v dialing, want the injected dialer's error", err)
+	}
+}
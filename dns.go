@@ -0,0 +1,143 @@
+package piad
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"time"
+
+	"go.jonnrb.io/piad/dns"
+	"go.jonnrb.io/piad/link"
+)
+
+// How the controller points things at the session's DNS servers.
+type DNSMode string
+
+const (
+	// Leave DNS alone.
+	DNSModeNone DNSMode = ""
+
+	// Rewrite /etc/resolv.conf, restoring the original on exit. With a netns,
+	// the namespace's own /etc/netns/<name>/resolv.conf (which "ip netns exec"
+	// mounts over /etc/resolv.conf) is used instead, since the host isn't
+	// tunneled.
+	DNSModeSystem DNSMode = "system"
+
+	// Write a resolv.conf to Controller.DNSFile (e.g. for sidecars), removing
+	// it on exit.
+	DNSModeFile DNSMode = "file"
+)
+
+const (
+	systemResolvConf = "/etc/resolv.conf"
+	netnsConfDir     = "/etc/netns"
+)
+
+func (c Controller) resolvConf() (rc dns.ResolvConf, ok bool, err error) {
+	switch c.DNSMode {
+	case DNSModeNone:
+		return
+	case DNSModeSystem:
+		ns := c.LinkConfig.Netns
+		switch {
+		case ns == "":
+			return dns.ResolvConf{Path: systemResolvConf, Backup: true}, true, nil
+		case link.IsNetnsPath(ns):
+			err = fmt.Errorf("DNS mode %q needs a named netns, not %q", c.DNSMode, ns)
+			return
+		default:
+			path := filepath.Join(netnsConfDir, ns, "resolv.conf")
+			return dns.ResolvConf{Path: path, Backup: true}, true, nil
+		}
+	case DNSModeFile:
+		if c.DNSFile == "" {
+			err = fmt.Errorf("DNS mode %q needs a file", c.DNSMode)
+			return
+		}
+		return dns.ResolvConf{Path: c.DNSFile}, true, nil
+	default:
+		err = fmt.Errorf("unknown DNS mode %q", c.DNSMode)
+		return
+	}
+}
+
+// The nameservers for lookups that skip the tunnel. DNSModeSystem points
+// /etc/resolv.conf at servers only reachable through it, so these come from its
+// backup. Otherwise (or before the first rewrite), the file is used as is.
+func (c Controller) outsideNameservers() []net.IP {
+	rc, ok, err := c.resolvConf()
+	if err != nil || !ok || rc.Path != systemResolvConf {
+		return nil
+	}
+	servers, ok, err := rc.BackedUpServers()
+	if err != nil {
+		log.Printf("error reading the original %q: %v", rc.Path, err)
+	}
+	if !ok {
+		return nil
+	}
+	return servers
+}
+
+// Keeps the resolv.conf (if any) and the forwarder pointed at the session's
+// DNS servers.
+func (s *controllerState) syncDNS() {
+	// Fail closed rather than let queries hang on a dead tunnel.
+	if s.healthy(time.Now()) {
+		s.fwd.SetServers(s.sn.DNSServers)
+	} else {
+		s.fwd.SetServers(nil)
+	}
+
+	rc, ok, _ := s.ctlr.resolvConf()
+	if !ok {
+		return
+	}
+
+	did, err := rc.Sync(s.sn.DNSServers)
+	if err != nil {
+		log.Printf("error syncing %q: %v", rc.Path, err)
+		return
+	}
+	if did {
+		log.Printf("pointed %q at %v", rc.Path, s.sn.DNSServers)
+	}
+}
+
+func (s *controllerState) syncDNSGuard() error {
+	if !s.ctlr.DNSGuard {
+		return nil
+	}
+
+	did, err := link.SyncDNSGuard(s.ctlr.LinkConfig)
+	if err != nil {
+		return err
+	}
+	if did {
+		log.Printf("installed DNS guard")
+	}
+	return nil
+}
+
+func (s *controllerState) serveDNS(ctx context.Context) error {
+	if s.ctlr.DNSListenAddr == "" {
+		return nil
+	}
+	return s.fwd.Listen(ctx, s.ctlr.DNSListenAddr)
+}
+
+func (s *controllerState) restoreDNS() {
+	s.fwd.SetServers(nil)
+
+	rc, ok, _ := s.ctlr.resolvConf()
+	if !ok {
+		return
+	}
+
+	err := rc.Restore()
+	if err != nil {
+		log.Printf("error restoring %q: %v", rc.Path, err)
+	}
+}
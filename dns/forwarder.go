@@ -0,0 +1,232 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long to wait on an upstream server before trying the next one.
+const upstreamTimeout = 5 * time.Second
+
+const maxMessageSize = 65535
+
+// Forwards DNS queries (over UDP and TCP) to a set of upstream servers.
+//
+// Upstream queries are made with Dial (or ordinary sockets if nil), which
+// should send them through the tunnel. With no servers set, every query is
+// answered with SERVFAIL.
+type Forwarder struct {
+	// Accessed atomically; kept first for alignment.
+	queries  uint64
+	failures uint64
+
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu      sync.Mutex
+	servers []net.IP
+}
+
+type Stats struct {
+	Queries  uint64
+	Failures uint64
+}
+
+// Sets the servers to forward to. Passing none makes the forwarder fail
+// closed.
+func (f *Forwarder) SetServers(servers []net.IP) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.servers = append([]net.IP(nil), servers...)
+}
+
+func (f *Forwarder) getServers() []net.IP {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.servers
+}
+
+func (f *Forwarder) Stats() Stats {
+	return Stats{
+		Queries:  atomic.LoadUint64(&f.queries),
+		Failures: atomic.LoadUint64(&f.failures),
+	}
+}
+
+// Listens on addr (UDP and TCP) and serves in the background until ctx is
+// done.
+func (f *Forwarder) Listen(ctx context.Context, addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		lis.Close()
+	}()
+	go f.serveUDP(ctx, pc)
+	go f.serveTCP(ctx, lis)
+	return nil
+}
+
+func (f *Forwarder) serveUDP(ctx context.Context, pc net.PacketConn) {
+	for {
+		b := make([]byte, maxMessageSize)
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("DNS forwarder stopped serving UDP: %v", err)
+			}
+			return
+		}
+		go func() {
+			res, ok := f.handle(ctx, "udp", b[:n])
+			if ok {
+				pc.WriteTo(res, addr)
+			}
+		}()
+	}
+}
+
+func (f *Forwarder) serveTCP(ctx context.Context, lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("DNS forwarder stopped serving TCP: %v", err)
+			}
+			return
+		}
+		go f.serveTCPConn(ctx, conn)
+	}
+}
+
+func (f *Forwarder) serveTCPConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * upstreamTimeout))
+		q, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		res, ok := f.handle(ctx, "tcp", q)
+		if !ok {
+			return
+		}
+		if err := writeTCPMessage(conn, res); err != nil {
+			return
+		}
+	}
+}
+
+// Forwards q, returning the response or a SERVFAIL. Garbage gets no response.
+func (f *Forwarder) handle(ctx context.Context, network string, q []byte) (res []byte, ok bool) {
+	if len(q) < headerLen {
+		return
+	}
+	atomic.AddUint64(&f.queries, 1)
+
+	res, err := f.exchange(ctx, network, q)
+	if err != nil {
+		atomic.AddUint64(&f.failures, 1)
+		res = servFail(q)
+	}
+	ok = true
+	return
+}
+
+var errNoServers = errors.New("no DNS servers")
+
+func (f *Forwarder) exchange(ctx context.Context, network string, q []byte) (res []byte, err error) {
+	err = errNoServers
+	for _, ip := range f.getServers() {
+		res, err = f.exchangeWith(ctx, network, ip, q)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+func (f *Forwarder) exchangeWith(ctx context.Context, network string, ip net.IP, q []byte) (res []byte, err error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+
+	dial := f.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), "53"))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if network == "tcp" {
+		err = writeTCPMessage(conn, q)
+		if err != nil {
+			return
+		}
+		res, err = readTCPMessage(conn)
+	} else {
+		_, err = conn.Write(q)
+		if err != nil {
+			return
+		}
+		b := make([]byte, maxMessageSize)
+		var n int
+		n, err = conn.Read(b)
+		res = b[:n]
+	}
+	if err == nil && (len(res) < headerLen || res[0] != q[0] || res[1] != q[1]) {
+		err = errors.New("mismatched DNS response")
+	}
+	return
+}
+
+const headerLen = 12
+
+// A header-only SERVFAIL response to q.
+func servFail(q []byte) []byte {
+	res := make([]byte, headerLen)
+	copy(res, q[:2])
+	// QR, the query's opcode and RD, and RA with RCODE 2.
+	res[2] = 0x80 | q[2]&0x79
+	res[3] = 0x80 | 2
+	return res
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func writeTCPMessage(w io.Writer, b []byte) error {
+	m := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(m, uint16(len(b)))
+	copy(m[2:], b)
+	_, err := w.Write(m)
+	return err
+}
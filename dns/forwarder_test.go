@@ -0,0 +1,182 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// A query for example.com/A with ID 0xbeef and RD set.
+var testQuery = []byte{
+	0xbe, 0xef, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+	0x00, 0x01, 0x00, 0x01,
+}
+
+// Answers every query by echoing it back with QR set.
+func answer(q []byte) []byte {
+	res := append([]byte(nil), q...)
+	res[2] |= 0x80
+	return res
+}
+
+// Serves answer over UDP and TCP on the same loopback port.
+func fakeUpstream(t *testing.T, ctx context.Context) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", lis.Addr().String())
+	if err != nil {
+		lis.Close()
+		t.Fatal(err)
+	}
+	go func() {
+		<-ctx.Done()
+		lis.Close()
+		pc.Close()
+	}()
+
+	go func() {
+		b := make([]byte, maxMessageSize)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(answer(b[:n]), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				q, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				writeTCPMessage(conn, answer(q))
+			}()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+// A Forwarder serving on loopback whose upstream queries all go to upstream.
+func testForwarder(t *testing.T, ctx context.Context, upstream string) (f *Forwarder, addr string) {
+	f = &Forwarder{
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, upstream)
+		},
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", lis.Addr().String())
+	if err != nil {
+		lis.Close()
+		t.Fatal(err)
+	}
+	go func() {
+		<-ctx.Done()
+		lis.Close()
+		pc.Close()
+	}()
+	go f.serveUDP(ctx, pc)
+	go f.serveTCP(ctx, lis)
+	return f, lis.Addr().String()
+}
+
+func query(t *testing.T, network, addr string) []byte {
+	conn, err := net.DialTimeout(network, addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, testQuery); err != nil {
+			t.Fatal(err)
+		}
+		res, err := readTCPMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if _, err := conn.Write(testQuery); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, maxMessageSize)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b[:n]
+}
+
+func TestForwarder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f, addr := testForwarder(t, ctx, fakeUpstream(t, ctx))
+	f.SetServers([]net.IP{net.IPv4(10, 0, 0, 243)})
+
+	for _, network := range []string{"udp", "tcp"} {
+		res := query(t, network, addr)
+		if want := answer(testQuery); string(res) != string(want) {
+			t.Errorf("%s: got %x, want %x", network, res, want)
+		}
+	}
+
+	if s, want := f.Stats(), (Stats{Queries: 2}); s != want {
+		t.Errorf("got stats %+v, want %+v", s, want)
+	}
+}
+
+func TestForwarderNoServers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f, addr := testForwarder(t, ctx, fakeUpstream(t, ctx))
+
+	for _, network := range []string{"udp", "tcp"} {
+		res := query(t, network, addr)
+		if len(res) != headerLen {
+			t.Fatalf("%s: expected a header-only response; got %x", network, res)
+		}
+		if res[0] != testQuery[0] || res[1] != testQuery[1] {
+			t.Errorf("%s: response ID %x doesn't match the query", network, res[:2])
+		}
+		if res[2]&0x80 == 0 {
+			t.Errorf("%s: response doesn't have QR set", network)
+		}
+		if rcode := res[3] & 0x0f; rcode != 2 {
+			t.Errorf("%s: got RCODE %d, want SERVFAIL", network, rcode)
+		}
+	}
+
+	if s, want := f.Stats(), (Stats{Queries: 2, Failures: 2}); s != want {
+		t.Errorf("got stats %+v, want %+v", s, want)
+	}
+}
+
+func TestForwarderIgnoresGarbage(t *testing.T) {
+	var f Forwarder
+	if _, ok := f.handle(context.Background(), "udp", []byte{1, 2, 3}); ok {
+		t.Error("expected no response to a truncated query")
+	}
+	if s := f.Stats(); s.Queries != 0 {
+		t.Errorf("expected garbage not to count as a query; got %+v", s)
+	}
+}
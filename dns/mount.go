@@ -0,0 +1,52 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+const etcResolvConf = "/etc/resolv.conf"
+
+// Moves the calling thread into a new mount namespace in which /etc/resolv.conf
+// points at servers. The caller should have the thread locked (e.g. because it
+// is about to exec).
+//
+// The replacement is written to a tmpfs briefly mounted over the temp dir,
+// which the bind mount over /etc/resolv.conf keeps alive once it's unmounted
+// again, so nothing is left behind on the host or hidden from the caller.
+func MountResolvConf(servers []net.IP) error {
+	err := unix.Unshare(unix.CLONE_NEWNS)
+	if err != nil {
+		return fmt.Errorf("error creating mount namespace: %w", err)
+	}
+
+	// Keep our mounts from propagating back to the host.
+	err = unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("error making mounts private: %w", err)
+	}
+
+	dir := os.TempDir()
+	err = unix.Mount("tmpfs", dir, "tmpfs", 0, "mode=0755")
+	if err != nil {
+		return fmt.Errorf("error mounting tmpfs on %q: %w", dir, err)
+	}
+
+	path := filepath.Join(dir, "resolv.conf")
+	_, err = ResolvConf{Path: path}.Sync(servers)
+	if err == nil {
+		err = unix.Mount(path, etcResolvConf, "", unix.MS_BIND, "")
+		if err != nil {
+			err = fmt.Errorf("error mounting over %q: %w", etcResolvConf, err)
+		}
+	}
+
+	if uerr := unix.Unmount(dir, unix.MNT_DETACH); err == nil && uerr != nil {
+		err = fmt.Errorf("error unmounting tmpfs from %q: %w", dir, uerr)
+	}
+	return err
+}
@@ -0,0 +1,205 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	backupSuffix = ".piad-backup"
+
+	// Marks that there was no original file, so Restore removes ours.
+	absentSuffix = ".piad-absent"
+)
+
+// A resolv.conf that is kept pointed at a session's DNS servers.
+//
+// The file is rewritten in place rather than replaced since /etc/resolv.conf
+// is often a bind mount (e.g. in containers).
+type ResolvConf struct {
+	Path string
+
+	// Keep a copy of the original file next to it to put back in Restore. If
+	// piad dies before restoring, the copy is left alone by the next run so
+	// the original isn't lost.
+	Backup bool
+}
+
+func (r ResolvConf) backupPath() string {
+	return r.Path + backupSuffix
+}
+
+func (r ResolvConf) absentPath() string {
+	return r.Path + absentSuffix
+}
+
+// Points the file at servers, if it isn't already.
+func (r ResolvConf) Sync(servers []net.IP) (did bool, err error) {
+	if len(servers) == 0 {
+		err = errors.New("no DNS servers")
+		return
+	}
+
+	want := render(servers)
+	have, err := ioutil.ReadFile(r.Path)
+	switch {
+	case err == nil && bytes.Equal(have, want):
+		return
+	case err != nil && !os.IsNotExist(err):
+		return
+	}
+
+	existed := err == nil
+	if !existed {
+		// e.g. a new /etc/netns/<name>.
+		err = os.MkdirAll(filepath.Dir(r.Path), 0755)
+		if err != nil {
+			return
+		}
+	}
+
+	if r.Backup {
+		err = r.backup(have, existed)
+		if err != nil {
+			err = fmt.Errorf("error backing up %q: %w", r.Path, err)
+			return
+		}
+	}
+
+	did = true
+	err = writeInPlace(r.Path, want)
+	return
+}
+
+func (r ResolvConf) backup(orig []byte, existed bool) error {
+	for _, p := range []string{r.backupPath(), r.absentPath()} {
+		_, err := os.Stat(p)
+		switch {
+		case err == nil:
+			// Either we made it earlier or a previous run didn't restore it.
+			return nil
+		case !os.IsNotExist(err):
+			return err
+		}
+	}
+
+	if !existed {
+		return ioutil.WriteFile(r.absentPath(), nil, 0644)
+	}
+	return ioutil.WriteFile(r.backupPath(), orig, 0644)
+}
+
+// Puts back the original file (if it was backed up) or removes ours.
+func (r ResolvConf) Restore() error {
+	if !r.Backup {
+		return removeIfExists(r.Path)
+	}
+
+	_, err := os.Stat(r.absentPath())
+	switch {
+	case err == nil:
+		err = removeIfExists(r.Path)
+		if err != nil {
+			return err
+		}
+		return os.Remove(r.absentPath())
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	orig, err := ioutil.ReadFile(r.backupPath())
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	err = writeInPlace(r.Path, orig)
+	if err != nil {
+		return err
+	}
+	return os.Remove(r.backupPath())
+}
+
+func removeIfExists(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// The nameservers in the original file, if it was backed up. Like Go's
+// resolver, a missing file or one without any means the local host's.
+func (r ResolvConf) BackedUpServers() (servers []net.IP, ok bool, err error) {
+	_, err = os.Stat(r.absentPath())
+	switch {
+	case err == nil:
+		return localServers(), true, nil
+	case !os.IsNotExist(err):
+		return
+	}
+
+	b, err := ioutil.ReadFile(r.backupPath())
+	switch {
+	case os.IsNotExist(err):
+		err = nil
+		return
+	case err != nil:
+		return
+	}
+
+	ok = true
+	servers = parseServers(b)
+	if len(servers) == 0 {
+		servers = localServers()
+	}
+	return
+}
+
+func parseServers(b []byte) []net.IP {
+	var servers []net.IP
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || f[0] != "nameserver" {
+			continue
+		}
+		// Drop any zone; the Go resolver would too for a bare address.
+		if ip := net.ParseIP(strings.SplitN(f[1], "%", 2)[0]); ip != nil {
+			servers = append(servers, ip)
+		}
+	}
+	return servers
+}
+
+func localServers() []net.IP {
+	return []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+}
+
+func render(servers []net.IP) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by piad\n")
+	for _, ip := range servers {
+		fmt.Fprintf(&buf, "nameserver %s\n", ip)
+	}
+	return buf.Bytes()
+}
+
+func writeInPlace(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
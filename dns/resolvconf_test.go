@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testResolvConf(t *testing.T) (r ResolvConf, cleanup func()) {
+	dir, err := ioutil.TempDir("", "resolvconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = ResolvConf{Path: filepath.Join(dir, "resolv.conf"), Backup: true}
+	return r, func() { os.RemoveAll(dir) }
+}
+
+var testServers = []net.IP{net.ParseIP("10.0.0.243"), net.ParseIP("10.0.0.242")}
+
+func syncAndRestore(t *testing.T, r ResolvConf) {
+	did, err := r.Sync(testServers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !did {
+		t.Fatal("expected Sync to rewrite the file")
+	}
+	b, err := ioutil.ReadFile(r.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := render(testServers); string(b) != string(want) {
+		t.Fatalf("got %q, want %q", b, want)
+	}
+
+	did, err = r.Sync(testServers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if did {
+		t.Error("expected Sync to leave an up to date file alone")
+	}
+
+	if err := r.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{r.backupPath(), r.absentPath()} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("expected %q to be gone after Restore; got %v", p, err)
+		}
+	}
+}
+
+func TestResolvConfRestore(t *testing.T) {
+	for _, orig := range []string{"nameserver 192.168.1.1\n", ""} {
+		r, cleanup := testResolvConf(t)
+		defer cleanup()
+
+		if err := ioutil.WriteFile(r.Path, []byte(orig), 0644); err != nil {
+			t.Fatal(err)
+		}
+		syncAndRestore(t, r)
+
+		b, err := ioutil.ReadFile(r.Path)
+		if err != nil {
+			t.Fatalf("original %q wasn't restored: %v", orig, err)
+		}
+		if string(b) != orig {
+			t.Errorf("got %q, want %q", b, orig)
+		}
+	}
+}
+
+func TestResolvConfRestoreAbsent(t *testing.T) {
+	r, cleanup := testResolvConf(t)
+	defer cleanup()
+
+	syncAndRestore(t, r)
+
+	if _, err := os.Stat(r.Path); !os.IsNotExist(err) {
+		t.Errorf("expected %q to be removed; got %v", r.Path, err)
+	}
+}
+
+func TestResolvConfKeepsEarlierBackup(t *testing.T) {
+	r, cleanup := testResolvConf(t)
+	defer cleanup()
+
+	// A previous run died after backing up the original.
+	orig := "nameserver 192.168.1.1\n"
+	if err := ioutil.WriteFile(r.backupPath(), []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(r.Path, render([]net.IP{net.IPv4(10, 0, 0, 1)}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	syncAndRestore(t, r)
+
+	b, err := ioutil.ReadFile(r.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != orig {
+		t.Errorf("got %q, want %q", b, orig)
+	}
+}
+
+func TestResolvConfMakesDir(t *testing.T) {
+	r, cleanup := testResolvConf(t)
+	defer cleanup()
+
+	// Like /etc/netns/<name> before anything is put in it.
+	r.Path = filepath.Join(filepath.Dir(r.Path), "netns", "vpn", "resolv.conf")
+	syncAndRestore(t, r)
+}
+
+func TestBackedUpServers(t *testing.T) {
+	r, cleanup := testResolvConf(t)
+	defer cleanup()
+
+	if _, ok, err := r.BackedUpServers(); ok || err != nil {
+		t.Fatalf("got ok=%v, err=%v before anything was backed up", ok, err)
+	}
+
+	orig := "search lan\nnameserver 192.168.1.1\nnameserver fe80::1%eth0\n"
+	if err := ioutil.WriteFile(r.Path, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Sync(testServers); err != nil {
+		t.Fatal(err)
+	}
+	servers, ok, err := r.BackedUpServers()
+	if !ok || err != nil {
+		t.Fatalf("got ok=%v, err=%v after backing up", ok, err)
+	}
+	if len(servers) != 2 || !servers[0].Equal(net.ParseIP("192.168.1.1")) ||
+		!servers[1].Equal(net.ParseIP("fe80::1")) {
+		t.Errorf("got %v, want the original's nameservers", servers)
+	}
+	if err := r.Restore(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without an original file, Go's resolver would have used the local host.
+	if err := os.Remove(r.Path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Sync(testServers); err != nil {
+		t.Fatal(err)
+	}
+	servers, ok, err = r.BackedUpServers()
+	if !ok || err != nil || len(servers) == 0 || !servers[0].IsLoopback() {
+		t.Errorf("got %v (ok=%v, err=%v), want the local host", servers, ok, err)
+	}
+}
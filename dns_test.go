@@ -0,0 +1,32 @@
+package piad
+
+import (
+	"testing"
+
+	"go.jonnrb.io/piad/link"
+)
+
+func TestSystemResolvConfInNetns(t *testing.T) {
+	cases := []struct {
+		netns, path string
+		ok          bool
+	}{
+		{"", "/etc/resolv.conf", true},
+		{"vpn", "/etc/netns/vpn/resolv.conf", true},
+		{"/proc/1234/ns/net", "", false},
+	}
+	for _, c := range cases {
+		ctlr := Controller{DNSMode: DNSModeSystem, LinkConfig: link.Config{Netns: c.netns}}
+		rc, _, err := ctlr.resolvConf()
+		switch {
+		case !c.ok:
+			if err == nil {
+				t.Errorf("netns %q: expected an error; got %q", c.netns, rc.Path)
+			}
+		case err != nil:
+			t.Errorf("netns %q: %v", c.netns, err)
+		case rc.Path != c.path || !rc.Backup:
+			t.Errorf("netns %q: got %+v, want a backed up %q", c.netns, rc, c.path)
+		}
+	}
+}
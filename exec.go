@@ -0,0 +1,92 @@
+package piad
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"go.jonnrb.io/piad/dns"
+	"go.jonnrb.io/piad/link"
+)
+
+// Replaces this process with argv, run in the link's network namespace with
+// /etc/resolv.conf pointing at the session's DNS servers. The running
+// controller is asked (over StatusAddr) for those, and argv isn't run unless it
+// reports that the tunnel is healthy.
+func (c Controller) Exec(ctx context.Context, argv []string) error {
+	if len(argv) == 0 {
+		return errors.New("no command to exec")
+	}
+	if c.LinkConfig.Netns == "" {
+		return errors.New("exec needs the link to be in a netns")
+	}
+
+	st, err := c.getStatus(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting controller status: %w", err)
+	}
+	switch {
+	case st.LastHandshake.IsZero():
+		return errors.New("tunnel hasn't handshaked yet")
+	case !st.Healthy:
+		return fmt.Errorf("tunnel isn't healthy (last handshake %v)", st.LastHandshake)
+	}
+	if len(st.DNSServers) == 0 {
+		return errors.New("controller didn't report any DNS servers")
+	}
+
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		return err
+	}
+
+	// Both leave the thread changed for good, which is fine since it's about
+	// to be replaced.
+	err = link.EnterNetns(c.LinkConfig.Netns)
+	if err != nil {
+		return err
+	}
+	err = dns.MountResolvConf(st.DNSServers)
+	if err != nil {
+		return err
+	}
+
+	return syscall.Exec(path, argv, os.Environ())
+}
+
+// Fetches the status from the controller serving it on StatusAddr.
+func (c Controller) getStatus(ctx context.Context) (st Status, err error) {
+	if c.StatusAddr == "" {
+		err = errors.New("no status address set")
+		return
+	}
+	host, port, err := net.SplitHostPort(c.StatusAddr)
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+net.JoinHostPort(host, port)+"/status", nil)
+	if err != nil {
+		return
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("got %s", res.Status)
+		return
+	}
+	err = json.NewDecoder(res.Body).Decode(&st)
+	return
+}
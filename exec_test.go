@@ -0,0 +1,15 @@
+package piad
+
+import (
+	"context"
+	"testing"
+
+	"go.jonnrb.io/piad/link"
+)
+
+func TestExecNeedsCommand(t *testing.T) {
+	c := Controller{LinkConfig: link.Config{Netns: "vpn"}}
+	if err := c.Exec(context.Background(), nil); err == nil {
+		t.Error("expected an error exec'ing nothing")
+	}
+}
@@ -0,0 +1,298 @@
+package piad
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.jonnrb.io/piad/api"
+	"go.jonnrb.io/piad/session"
+)
+
+// Returned when the current server can't be used anymore and the controller
+// should move on to another one.
+var errServerFailed = errors.New("server failed")
+
+const (
+	// How long a server that failed once is skipped for. This doubles with
+	// each failure up to maxServerPenalty.
+	serverPenalty    = time.Minute
+	maxServerPenalty = time.Hour
+
+	DefaultRegionRetryInterval = 30 * time.Minute
+)
+
+type serverFailures struct {
+	count     int
+	skipUntil time.Time
+}
+
+func serverKey(srv session.Server) string {
+	return srv.Addr.String()
+}
+
+func (s *controllerState) useFirstUsableRegion() error {
+	for i, dns := range s.ctlr.Regions {
+		r, err := s.ctlr.usableRegion(s.serverList, dns)
+		if err != nil {
+			log.Printf("skipping region: %v", err)
+			continue
+		}
+		s.useRegion(i, r, r.Servers[0], time.Now())
+		return nil
+	}
+	return fmt.Errorf("none of the regions %q are usable", s.ctlr.Regions)
+}
+
+func (s *controllerState) useRegion(i int, r session.Region, srv session.Server, now time.Time) {
+	if s.region.DNS != r.DNS {
+		log.Printf("using region %q", r.DNS)
+	}
+	s.regionIdx = i
+	s.region = r
+	s.srv = srv
+	switch {
+	case i == 0:
+		s.nextRegionRetry = time.Time{}
+	case s.nextRegionRetry.IsZero():
+		s.nextRegionRetry = now.Add(s.regionRetryInterval())
+	}
+}
+
+func (s *controllerState) regionRetryInterval() time.Duration {
+	if s.ctlr.RegionRetryInterval == 0 {
+		return DefaultRegionRetryInterval
+	}
+	return s.ctlr.RegionRetryInterval
+}
+
+// Penalizes the current server and switches to the next one that isn't being
+// skipped, first in the current region and then in the regions after it. If
+// every server is being skipped, waits for the first one to be let back in
+// rather than giving up (which would take the tunnel down with it).
+func (s *controllerState) failover(ctx context.Context) error {
+	now := time.Now()
+	s.recordFailure(s.srv, now)
+
+	prev := s.srv
+	for !s.nextServer(now) {
+		wait := s.nextUnskip(now).Sub(now)
+		log.Printf(
+			"all servers in regions %q have failed recently; trying again in %v",
+			s.ctlr.Regions, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		now = time.Now()
+	}
+	if serverKey(prev) == serverKey(s.srv) {
+		log.Printf("trying server %q again", s.srv.CommonName)
+	} else {
+		log.Printf("switching from server %q to %q", prev.CommonName, s.srv.CommonName)
+	}
+
+	// The key was never added to the new server and it won't have handshaked
+	// yet.
+	s.isRefresh = false
+	s.lastHandshake = now
+	s.handshake = time.Time{}
+	return nil
+}
+
+func (s *controllerState) recordFailure(srv session.Server, now time.Time) {
+	f, ok := s.failures[serverKey(srv)]
+	if !ok {
+		f = &serverFailures{}
+		s.failures[serverKey(srv)] = f
+	}
+	f.count++
+
+	penalty := maxServerPenalty
+	if f.count <= 6 {
+		penalty = serverPenalty << (f.count - 1)
+	}
+	if penalty > maxServerPenalty {
+		penalty = maxServerPenalty
+	}
+	f.skipUntil = now.Add(penalty)
+}
+
+// Forgets srv's failures once it's working again, so a later blip is
+// penalized like a first failure.
+func (s *controllerState) clearFailures(srv session.Server) {
+	delete(s.failures, serverKey(srv))
+}
+
+func (s *controllerState) isSkipped(srv session.Server, now time.Time) bool {
+	f, ok := s.failures[serverKey(srv)]
+	return ok && now.Before(f.skipUntil)
+}
+
+// When the first server in a usable region stops being skipped, or after
+// serverPenalty if there are none.
+func (s *controllerState) nextUnskip(now time.Time) time.Time {
+	next := now.Add(serverPenalty)
+	for _, dns := range s.ctlr.Regions {
+		r, err := s.ctlr.usableRegion(s.serverList, dns)
+		if err != nil {
+			continue
+		}
+		for _, srv := range r.Servers {
+			f, ok := s.failures[serverKey(srv)]
+			if !ok {
+				return now
+			}
+			if f.skipUntil.Before(next) {
+				next = f.skipUntil
+			}
+		}
+	}
+	return next
+}
+
+// Moves to the first server after the current one that isn't being skipped,
+// wrapping around to the first region after the last.
+func (s *controllerState) nextServer(now time.Time) bool {
+	cur := 0
+	for i, srv := range s.region.Servers {
+		if serverKey(srv) == serverKey(s.srv) {
+			cur = i
+			break
+		}
+	}
+	for i := cur + 1; i < len(s.region.Servers); i++ {
+		if srv := s.region.Servers[i]; !s.isSkipped(srv, now) {
+			s.srv = srv
+			return true
+		}
+	}
+
+	n := len(s.ctlr.Regions)
+	for i := 1; i <= n; i++ {
+		ri := (s.regionIdx + i) % n
+		r, err := s.ctlr.usableRegion(s.serverList, s.ctlr.Regions[ri])
+		if err != nil {
+			continue
+		}
+		for _, srv := range r.Servers {
+			if !s.isSkipped(srv, now) {
+				s.useRegion(ri, r, srv, now)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type regionCandidate struct {
+	idx    int
+	region session.Region
+	srv    session.Server
+}
+
+type regionReturn struct {
+	// The key that was added, so a result from before a key rotation is
+	// dropped.
+	pk session.PublicKey
+
+	// The server the key was added to, if any.
+	to *regionCandidate
+	sn session.Session
+
+	failed []session.Server
+}
+
+// While on a fallback region, periodically tries adding the key to a server in
+// the preferred region and switches to it if that works. The current tunnel is
+// left alone if it doesn't.
+//
+// Like refreshServerList, the servers are tried in the background (so that
+// they don't hold up the handshake watchdog) and the result is picked up on a
+// later call.
+func (s *controllerState) maybeReturnToPreferredRegion(ctx context.Context) {
+	select {
+	case u := <-s.regionReturns:
+		s.applyRegionReturn(u)
+	default:
+	}
+
+	now := time.Now()
+	if s.regionIdx == 0 || s.returningToRegion || now.Before(s.nextRegionRetry) {
+		return
+	}
+	s.nextRegionRetry = now.Add(s.regionRetryInterval())
+
+	var cs []regionCandidate
+	for i, dns := range s.ctlr.Regions[:s.regionIdx] {
+		r, err := s.ctlr.usableRegion(s.serverList, dns)
+		if err != nil {
+			continue
+		}
+		for _, srv := range r.Servers {
+			if !s.isSkipped(srv, now) {
+				cs = append(cs, regionCandidate{i, r, srv})
+			}
+		}
+	}
+	if len(cs) == 0 {
+		return
+	}
+
+	s.returningToRegion = true
+	cli, tokens, pk := s.cli, s.tokens, s.pk
+	go func() {
+		s.regionReturns <- tryRegionCandidates(ctx, cli, tokens, pk, cs)
+	}()
+}
+
+// Adds pk to each of cs in turn until one takes it.
+func tryRegionCandidates(ctx context.Context, cli *api.Client, tokens *api.TokenCache, pk session.PublicKey, cs []regionCandidate) (u regionReturn) {
+	u.pk = pk
+	for i := range cs {
+		c := &cs[i]
+		sn, err := c.srv.AddKey(ctx, cli, tokens, pk)
+		var tokErr *session.TokenError
+		if errors.As(err, &tokErr) {
+			log.Printf("couldn't return to region %q: %v", c.region.DNS, err)
+			return
+		}
+		if err != nil {
+			log.Printf(
+				"couldn't return to region %q with server %q: %v",
+				c.region.DNS, c.srv.CommonName, err)
+			u.failed = append(u.failed, c.srv)
+			continue
+		}
+		u.to = c
+		u.sn = sn
+		return
+	}
+	return
+}
+
+func (s *controllerState) applyRegionReturn(u regionReturn) {
+	s.returningToRegion = false
+
+	now := time.Now()
+	for _, srv := range u.failed {
+		s.recordFailure(srv, now)
+	}
+	// We may have rotated the key or failed over to a better region since.
+	if u.to == nil || u.pk != s.pk || u.to.idx >= s.regionIdx {
+		return
+	}
+
+	log.Printf("returning to region %q", u.to.region.DNS)
+	s.useRegion(u.to.idx, u.to.region, u.to.srv, now)
+	s.sn = u.sn
+	s.pf = nil
+	s.nextPortForward = time.Time{}
+	s.isRefresh = true
+	s.lastHandshake = now
+	s.handshake = time.Time{}
+	s.saveState()
+}
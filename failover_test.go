@@ -0,0 +1,195 @@
+package piad
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"go.jonnrb.io/piad/session"
+)
+
+func testServer(ip string) session.Server {
+	return session.Server{
+		Addr:       net.TCPAddr{IP: net.ParseIP(ip), Port: 1337},
+		CommonName: ip,
+	}
+}
+
+func testState(regions map[string][]session.Server, order ...string) *controllerState {
+	l := make(session.ServerList)
+	for dns, ss := range regions {
+		l[dns] = session.Region{DNS: dns, Servers: ss}
+	}
+	s := &controllerState{
+		ctlr:       Controller{Regions: order},
+		serverList: l,
+		failures:   make(map[string]*serverFailures),
+	}
+	s.useRegion(0, l[order[0]], l[order[0]].Servers[0], time.Now())
+	return s
+}
+
+func TestRecordFailure(t *testing.T) {
+	s := testState(map[string][]session.Server{
+		"a": {testServer("192.0.2.1")},
+	}, "a")
+	srv := s.srv
+	now := time.Now()
+
+	for i, want := range []time.Duration{
+		serverPenalty,
+		2 * serverPenalty,
+		4 * serverPenalty,
+		8 * serverPenalty,
+		16 * serverPenalty,
+		32 * serverPenalty,
+		maxServerPenalty,
+		maxServerPenalty,
+	} {
+		s.recordFailure(srv, now)
+		if got := s.failures[serverKey(srv)].skipUntil.Sub(now); got != want {
+			t.Errorf("failure %d: skipped for %v, want %v", i+1, got, want)
+		}
+	}
+	if !s.isSkipped(srv, now.Add(maxServerPenalty-time.Second)) {
+		t.Error("server isn't skipped")
+	}
+
+	s.clearFailures(srv)
+	if s.isSkipped(srv, now) {
+		t.Error("server is still skipped after its failures were cleared")
+	}
+	s.recordFailure(srv, now)
+	if got := s.failures[serverKey(srv)].skipUntil.Sub(now); got != serverPenalty {
+		t.Errorf("first failure after clearing: skipped for %v, want %v", got, serverPenalty)
+	}
+}
+
+func TestNextServerInRegion(t *testing.T) {
+	a1, a2, a3 := testServer("192.0.2.1"), testServer("192.0.2.2"), testServer("192.0.2.3")
+	s := testState(map[string][]session.Server{
+		"a": {a1, a2, a3},
+	}, "a")
+	now := time.Now()
+
+	s.recordFailure(a1, now)
+	s.recordFailure(a2, now)
+	if !s.nextServer(now) || serverKey(s.srv) != serverKey(a3) {
+		t.Fatalf("got server %v, want %v (skipping the failed %v)", s.srv.CommonName, a3.CommonName, a2.CommonName)
+	}
+
+	s.recordFailure(a3, now)
+	if s.nextServer(now) {
+		t.Errorf("got server %v with every server skipped", s.srv.CommonName)
+	}
+
+	// Once the penalties run out, the servers get another chance.
+	if !s.nextServer(now.Add(maxServerPenalty)) || serverKey(s.srv) != serverKey(a1) {
+		t.Errorf("got server %v after the penalties ran out, want %v", s.srv.CommonName, a1.CommonName)
+	}
+}
+
+func TestFailoverWaitsForAServer(t *testing.T) {
+	a1 := testServer("192.0.2.1")
+	s := testState(map[string][]session.Server{
+		"a": {a1},
+	}, "a")
+
+	// The only server has to sit out its penalty, so failover waits for it
+	// instead of giving up.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.failover(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want failover to wait until ctx was done", err)
+	}
+
+	now := time.Now()
+	want := s.failures[serverKey(a1)].skipUntil
+	if got := s.nextUnskip(now); !got.Equal(want) {
+		t.Errorf("waiting until %v, want %v", got, want)
+	}
+}
+
+func TestNextServerAcrossRegions(t *testing.T) {
+	a1, b1, c1 := testServer("192.0.2.1"), testServer("198.51.100.1"), testServer("203.0.113.1")
+	s := testState(map[string][]session.Server{
+		"a": {a1},
+		"b": {b1},
+		"c": {c1},
+	}, "a", "b", "c")
+	now := time.Now()
+
+	s.recordFailure(a1, now)
+	s.recordFailure(b1, now)
+	if !s.nextServer(now) || s.region.DNS != "c" || s.regionIdx != 2 {
+		t.Fatalf("got region %q (%d), want \"c\" (2)", s.region.DNS, s.regionIdx)
+	}
+	if s.nextRegionRetry.IsZero() {
+		t.Error("no retry of the preferred region scheduled on a fallback region")
+	}
+
+	s.recordFailure(c1, now)
+	if s.nextServer(now) {
+		t.Errorf("got region %q with every server skipped", s.region.DNS)
+	}
+}
+
+func TestFailoverWaitsOutRegionOutage(t *testing.T) {
+	a1, b1 := testServer("192.0.2.1"), testServer("198.51.100.1")
+	s := testState(map[string][]session.Server{
+		"a": {a1},
+		"b": {b1},
+	}, "a", "b")
+	now := time.Now()
+
+	// b failed a while ago, so it comes back before a, which fails now.
+	s.recordFailure(b1, now.Add(-30*time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.failover(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want failover to wait out the outage", err)
+	}
+
+	want := s.failures[serverKey(b1)].skipUntil
+	if got := s.nextUnskip(time.Now()); !got.Equal(want) {
+		t.Errorf("waiting until %v, want %v (when %v comes back)", got, want, b1.CommonName)
+	}
+	if !s.nextServer(want) || serverKey(s.srv) != serverKey(b1) {
+		t.Errorf("got server %v once the outage is over, want %v", s.srv.CommonName, b1.CommonName)
+	}
+}
+
+func TestApplyRegionReturn(t *testing.T) {
+	a1, b1 := testServer("192.0.2.1"), testServer("198.51.100.1")
+	s := testState(map[string][]session.Server{
+		"a": {a1},
+		"b": {b1},
+	}, "a", "b")
+	s.useRegion(1, s.serverList["b"], b1, time.Now())
+
+	a := s.serverList["a"]
+	sn := session.Session{ServerVIP: net.ParseIP("10.0.0.1")}
+
+	// A result for an old key is dropped.
+	s.applyRegionReturn(regionReturn{
+		pk: session.PublicKey{1},
+		to: &regionCandidate{0, a, a1},
+		sn: sn,
+	})
+	if s.regionIdx != 1 {
+		t.Fatalf("switched to region %q for a stale key", s.region.DNS)
+	}
+
+	s.applyRegionReturn(regionReturn{
+		pk: s.pk,
+		to: &regionCandidate{0, a, a1},
+		sn: sn,
+	})
+	if s.regionIdx != 0 || !s.sn.ServerVIP.Equal(sn.ServerVIP) {
+		t.Errorf("got region %q with VIP %v, want \"a\" with %v", s.region.DNS, s.sn.ServerVIP, sn.ServerVIP)
+	}
+	if !s.nextRegionRetry.IsZero() {
+		t.Error("still retrying the preferred region after returning to it")
+	}
+}
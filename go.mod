@@ -3,6 +3,9 @@ module go.jonnrb.io/piad
 go 1.14
 
 require (
-	github.com/vishvananda/netlink v1.1.1-0.20200802231818-98629f7ffc4b
+	github.com/google/nftables v0.1.0
+	github.com/vishvananda/netlink v1.3.0
+	github.com/vishvananda/netns v0.0.4
+	golang.org/x/sys v0.10.0
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20200609130330-bd2cb7843e1b
 )
@@ -0,0 +1,64 @@
+package piad
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.jonnrb.io/piad/session"
+)
+
+const keyRotationRetryDelay = 5 * time.Minute
+
+// Rotates the key once it's older than KeyRotationInterval. Failures leave the
+// current key in place and are retried later.
+func (s *controllerState) maybeRotateKey(ctx context.Context) {
+	if s.ctlr.KeyRotationInterval == 0 {
+		return
+	}
+
+	now := time.Now()
+	if now.Before(s.keyCreatedAt.Add(s.ctlr.KeyRotationInterval)) ||
+		now.Before(s.nextKeyRotationAttempt) {
+		return
+	}
+
+	err := s.rotateKey(ctx, now)
+	if err != nil {
+		log.Printf("error rotating key: %v", err)
+		s.nextKeyRotationAttempt = now.Add(keyRotationRetryDelay)
+		return
+	}
+	log.Printf("rotated key; new public key is %v", s.pk)
+}
+
+// Registers a new key with the current server while the old one is still in
+// use, then switches the device over to it.
+func (s *controllerState) rotateKey(ctx context.Context, now time.Time) error {
+	sk, err := session.NewKey()
+	if err != nil {
+		return fmt.Errorf("could not generate key: %w", err)
+	}
+
+	sn, err := s.srv.AddKey(ctx, s.cli, s.tokens, sk.PublicKey())
+	if err != nil {
+		return fmt.Errorf("error adding new key to server %q: %w", s.srv.CommonName, err)
+	}
+
+	err = s.l.Rekey(s.ctlr.LinkConfig, sk, sn)
+	if err != nil {
+		return fmt.Errorf("error switching link %q to new key: %w", string(s.l), err)
+	}
+
+	if !sn.ServerVIP.Equal(s.sn.ServerVIP) {
+		// Forwarded ports are tied to the server.
+		s.pf = nil
+		s.nextPortForward = time.Time{}
+	}
+	s.sk, s.pk, s.sn = sk, sk.PublicKey(), sn
+	s.keyCreatedAt = now
+	s.keyRotated = true
+	s.saveState()
+	return nil
+}
@@ -0,0 +1,103 @@
+package link
+
+import (
+	"errors"
+	"net"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"go.jonnrb.io/piad/session"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Reports whether a link left up by a previous run matches sn closely enough
+// to take over without touching it: the device is up using sk with sn's server
+// as its peer, our table routes through sn's gateway, and our rules are in
+// place.
+func (l Link) CanAdopt(cfg Config, sk session.SecretKey, sn session.Session) (ok bool, err error) {
+	err = inNetns(cfg.Netns, func() (err error) {
+		ok, err = l.canAdopt(cfg, sk, sn)
+		return
+	})
+	return
+}
+
+func (l Link) canAdopt(cfg Config, sk session.SecretKey, sn session.Session) (bool, error) {
+	ok, err := l.devMatches(cfg, sk, sn)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	nl, err := netlink.LinkByName(string(l))
+	if err != nil {
+		return false, err
+	}
+	ok, err = cfg.hasRoutes(netlink.FAMILY_V4, cfg.v4Routes(sn, nl.Attrs().Index))
+	if err != nil || !ok {
+		return false, err
+	}
+
+	for _, family := range families {
+		allRules, err := netlink.RuleList(family)
+		if err != nil {
+			return false, err
+		}
+		for _, want := range cfg.blackholeRules(family) {
+			found := false
+			for _, r := range allRules {
+				found = found || ruleMatches(want, r)
+			}
+			if !found {
+				return false, nil
+			}
+		}
+	}
+
+	return true, nil
+}
+
+func (l Link) devMatches(cfg Config, sk session.SecretKey, sn session.Session) (bool, error) {
+	cli, err := wgctrl.New()
+	if err != nil {
+		return false, err
+	}
+	defer cli.Close()
+
+	dev, err := cli.Device(string(l))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	if dev.PrivateKey != wgtypes.Key(sk) || dev.FirewallMark != cfg.fwMark() ||
+		len(dev.Peers) != 1 {
+		return false, nil
+	}
+	p := dev.Peers[0]
+	if p.PublicKey != wgtypes.Key(sn.ServerKey) ||
+		!udpAddrEqual(p.Endpoint, &sn.ServerAddr) {
+		return false, nil
+	}
+
+	nl, err := netlink.LinkByName(string(l))
+	if err != nil {
+		return false, err
+	}
+	if nl.Attrs().Flags&net.FlagUp == 0 {
+		return false, nil
+	}
+
+	addrs, err := netlink.AddrList(nl, netlink.FAMILY_V4)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(sn.PeerIP) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -1,35 +1,72 @@
 package link
 
 import (
-	"errors"
 	"fmt"
-	"os"
 
 	"github.com/vishvananda/netlink"
 )
 
-// Tears down routes and rules, but can be revived via l.Sync().
-func (l Link) Stop() error {
-	if err := flushRoutes(); err != nil {
+// Tears down routes, rules and gateway mode, but can be revived via l.Sync().
+func (l Link) Stop(cfg Config) error {
+	return inNetns(cfg.Netns, func() error {
+		return l.stop(cfg)
+	})
+}
+
+func (l Link) stop(cfg Config) error {
+	if err := l.flushRoutes(cfg); err != nil {
 		return fmt.Errorf("error flushing routes: %w", err)
 	}
-	if err := flushRules(); err != nil {
+	if err := cfg.flushRules(); err != nil {
 		return fmt.Errorf("error flushing rules: %w", err)
 	}
+	if err := l.flushGateway(cfg); err != nil {
+		return fmt.Errorf("error tearing down gateway mode: %w", err)
+	}
 	return nil
 }
 
-func (l Link) Close() error {
+func (l Link) Close(cfg Config) error {
+	return inNetns(cfg.Netns, func() error {
+		if err := l.closeDev(); err != nil {
+			return fmt.Errorf("error closing dev %q: %w", string(l), err)
+		}
+		return l.stop(cfg)
+	})
+}
+
+// Like l.Close(), but leaves our rules in place and points our routing table
+// at a blackhole so nothing gets out until the next l.Sync(). Gateway mode is
+// still torn down.
+func (l Link) CloseAndBlock(cfg Config) error {
+	return inNetns(cfg.Netns, func() error {
+		return l.closeAndBlock(cfg)
+	})
+}
+
+func (l Link) closeAndBlock(cfg Config) error {
 	if err := l.closeDev(); err != nil {
 		return fmt.Errorf("error closing dev %q: %w", string(l), err)
 	}
-	return l.Stop()
+	if err := l.flushRoutes(cfg); err != nil {
+		return fmt.Errorf("error flushing routes: %w", err)
+	}
+	if err := cfg.addBlackholeRoutes(); err != nil {
+		return fmt.Errorf("error adding blackhole routes: %w", err)
+	}
+	if _, err := cfg.syncRules(); err != nil {
+		return fmt.Errorf("error syncing rules: %w", err)
+	}
+	if err := l.flushGateway(cfg); err != nil {
+		return fmt.Errorf("error tearing down gateway mode: %w", err)
+	}
+	return nil
 }
 
 func (l Link) closeDev() error {
 	nl, err := netlink.LinkByName(string(l))
 	switch {
-	case errors.Is(err, os.ErrNotExist):
+	case isNotFound(err):
 		return nil
 	case err == nil:
 		return netlink.LinkDel(nl)
@@ -38,36 +75,65 @@ func (l Link) closeDev() error {
 	}
 }
 
-func flushRoutes() error {
-	rs, err := getOurRoutingTable()
-	if err != nil {
-		return err
+func (l Link) flushRoutes(cfg Config) error {
+	linkIndex := 0
+	if nl, err := netlink.LinkByName(string(l)); err == nil {
+		linkIndex = nl.Attrs().Index
+	}
+
+	for _, family := range families {
+		rs, err := cfg.getOurRoutingTable(family)
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			if !cfg.ownsRoute(r, linkIndex) {
+				continue
+			}
+			if err := netlink.RouteDel(&r); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
+
+// Blackholes what would go through the tunnel: everything, or just
+// IncludePrefixes. Excluded prefixes keep their throw routes.
+func (c Config) addBlackholeRoutes() error {
+	rs := append(c.v4BlackholeRoutes(), c.v6Routes()...)
+	rs = append(rs, c.throwRoutes(netlink.FAMILY_V4)...)
 	for _, r := range rs {
-		if err := netlink.RouteDel(&r); err != nil {
+		if err := netlink.RouteReplace(&r); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func flushRules() error {
-	allRules, err := netlink.RuleList(netlink.FAMILY_V4)
+func (c Config) flushRules() error {
+	if c.Netns != "" {
+		return nil
+	}
+	for _, family := range families {
+		if err := c.flushRulesForFamily(family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Config) flushRulesForFamily(family int) error {
+	allRules, err := netlink.RuleList(family)
 	if err != nil {
 		return fmt.Errorf("error getting routing rules: %w", err)
 	}
 
 	for _, r := range allRules {
-		hasMark := r.Mark == FwMark
-		hasOurTable := r.Table == FwMark
-		hasInvert := r.Invert == true
-
-		hasMainTable := r.Table == 254
-		hasSuppressPrefixLen := r.SuppressPrefixlen == 0
-
-		if (hasMark && hasOurTable && hasInvert) ||
-			(hasMainTable && hasSuppressPrefixLen) {
-			return netlink.RuleDel(&r)
+		if c.isOurRule(r) {
+			if err := netlink.RuleDel(&r); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -0,0 +1,219 @@
+package link
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"go.jonnrb.io/piad/session"
+)
+
+const (
+	DefaultFwMark = 1337
+	mainTable     = 254
+)
+
+// Where the link keeps its policy routing. The zero value uses
+// DefaultFwMark for both the mark and the table, and lets the kernel pick rule
+// priorities (putting each new rule in front of the existing ones).
+type Config struct {
+	// Put on the wg device's traffic (and on Dialer's sockets) so it skips
+	// the tunnel.
+	FwMark int
+
+	// Our routing table. Defaults to FwMark.
+	Table int
+
+	// Consulted (without its default route) before our table so traffic to
+	// the LAN and such doesn't go through the tunnel. Defaults to main.
+	ExemptTable int
+
+	// Only tunnel traffic carrying this mark, coming from one of these
+	// sources, or sent by one of these users, instead of everything. This is
+	// how several tunnels share a host: only one of them can catch everything
+	// (and that one also catches the other tunnels' own traffic).
+	SteerMark    int
+	SteerSources []net.IPNet
+	SteerUIDs    []UIDRange
+
+	// Only send these prefixes through the tunnel (v6 ones are refused,
+	// since sessions have no v6 address), or keep these out of it. The two
+	// can't overlap, and excludes can't cover the session's gateway or DNS
+	// servers. With includes, the kill switch left by CloseAndBlock only
+	// blocks them; everything else keeps using the exempt table's routes.
+	IncludePrefixes []net.IPNet
+	ExcludePrefixes []net.IPNet
+
+	// Turn on IP forwarding and masquerade traffic leaving the link, for
+	// routing other hosts' traffic (e.g. steered in with SteerSources)
+	// through the tunnel.
+	Gateway bool
+
+	// Move the device into this network namespace, given by name (e.g. one
+	// made with "ip netns add") or by path (e.g. /proc/<pid>/ns/net), where it
+	// is the only way out, instead of using policy routing. The device is
+	// created here first so the tunnel itself still uses this namespace's
+	// network. Steering, gateway mode and the settings for rules don't apply.
+	Netns string
+
+	// Rule priorities. Must be in this order when set.
+	DNSGuardPriority  int
+	ExemptionPriority int
+	BlackholePriority int
+}
+
+// An inclusive range of UIDs.
+type UIDRange struct {
+	Start, End uint32
+}
+
+func (r UIDRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+func (c Config) fwMark() int {
+	if c.FwMark == 0 {
+		return DefaultFwMark
+	}
+	return c.FwMark
+}
+
+func (c Config) table() int {
+	if c.Netns != "" {
+		return mainTable
+	}
+	if c.Table == 0 {
+		return c.fwMark()
+	}
+	return c.Table
+}
+
+func (c Config) exemptTable() int {
+	if c.ExemptTable == 0 {
+		return mainTable
+	}
+	return c.ExemptTable
+}
+
+// netlink uses -1 for "unset".
+func rulePriority(p int) int {
+	if p == 0 {
+		return -1
+	}
+	return p
+}
+
+func (c Config) validate() error {
+	for _, in := range c.IncludePrefixes {
+		for _, ex := range c.ExcludePrefixes {
+			if ipNetsOverlap(in, ex) {
+				return fmt.Errorf("included prefix %v overlaps excluded prefix %v", &in, &ex)
+			}
+		}
+	}
+	if c.Netns != "" {
+		if c.steered() || c.Gateway {
+			return errors.New("steering and gateway mode can't be used with a netns")
+		}
+		return nil
+	}
+	if c.table() == c.exemptTable() {
+		return fmt.Errorf("table %d is also the exempt table", c.table())
+	}
+	steers := 0
+	for _, steer := range []bool{c.SteerMark != 0, len(c.SteerSources) != 0, len(c.SteerUIDs) != 0} {
+		if steer {
+			steers++
+		}
+	}
+	if steers > 1 {
+		return errors.New("can only steer by one of mark, source or UID")
+	}
+	for _, r := range c.SteerUIDs {
+		switch {
+		case r.Start > r.End:
+			return fmt.Errorf("invalid UID range %v", r)
+		case r.Start == 0:
+			// piad (and the wg device) would end up in the tunnel too.
+			return fmt.Errorf("UID range %v includes root", r)
+		}
+	}
+	if c.SteerMark == c.fwMark() {
+		return fmt.Errorf("can't steer traffic with the tunnel's own mark %d", c.SteerMark)
+	}
+
+	ps := []int{c.DNSGuardPriority, c.ExemptionPriority, c.BlackholePriority}
+	last := 0
+	for _, p := range ps {
+		if p < 0 {
+			return fmt.Errorf("invalid rule priority %d", p)
+		}
+		if p == 0 {
+			continue
+		}
+		if p <= last {
+			return fmt.Errorf(
+				"rule priorities must increase from the DNS guard to the exemption to the blackhole rule: %d, %d, %d",
+				c.DNSGuardPriority, c.ExemptionPriority, c.BlackholePriority)
+		}
+		last = p
+	}
+	return nil
+}
+
+func ipNetsOverlap(a, b net.IPNet) bool {
+	return ipFamily(a.IP) == ipFamily(b.IP) && (a.Contains(b.IP) || b.Contains(a.IP))
+}
+
+// Checks that s can be used with c: an excluded prefix covering the session's
+// gateway or DNS servers would send their traffic around the tunnel.
+func (c Config) validateSession(s session.Session) error {
+	ips := append([]net.IP{s.ServerVIP}, s.DNSServers...)
+	for _, n := range c.ExcludePrefixes {
+		for _, ip := range ips {
+			if n.Contains(ip) {
+				return fmt.Errorf("excluded prefix %v covers %v from the session", &n, ip)
+			}
+		}
+	}
+	return nil
+}
+
+// Checks that c makes sense and that nothing else on the host uses our mark,
+// our table or our rule priorities. Rules left behind by a previous run with
+// the same config aren't conflicts.
+func (c Config) CheckConflicts() error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if c.Netns != "" {
+		return nil
+	}
+
+	for _, family := range families {
+		allRules, err := netlink.RuleList(family)
+		if err != nil {
+			return fmt.Errorf("error getting routing rules: %w", err)
+		}
+
+		for _, r := range allRules {
+			if c.isOurRule(r) {
+				continue
+			}
+			switch {
+			case !c.steered() && r.Invert && r.Mark > 0:
+				return fmt.Errorf("rule %v already catches everything not marked %d", r, r.Mark)
+			case r.Mark == uint32(c.fwMark()) || (c.SteerMark != 0 && r.Mark == uint32(c.SteerMark)):
+				return fmt.Errorf("rule %v already uses fwmark %d", r, r.Mark)
+			case r.Table == c.table():
+				return fmt.Errorf("rule %v already uses table %d", r, c.table())
+			case r.Priority != 0 && (r.Priority == c.DNSGuardPriority ||
+				r.Priority == c.ExemptionPriority ||
+				r.Priority == c.BlackholePriority):
+				return fmt.Errorf("rule %v already has priority %d", r, r.Priority)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package link
+
+import (
+	"net"
+	"testing"
+
+	"go.jonnrb.io/piad/session"
+)
+
+func cidr(t *testing.T, s string) net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *n
+}
+
+func TestValidatePrefixes(t *testing.T) {
+	cases := []struct {
+		include, exclude string
+		ok               bool
+	}{
+		{"10.0.0.0/8", "192.168.0.0/16", true},
+		{"10.0.0.0/8", "10.1.0.0/16", false},
+		{"10.1.0.0/16", "10.0.0.0/8", false},
+		{"10.0.0.0/8", "10.0.0.0/8", false},
+		{"10.0.0.0/8", "fd00::/8", true},
+	}
+	for _, c := range cases {
+		cfg := Config{
+			IncludePrefixes: []net.IPNet{cidr(t, c.include)},
+			ExcludePrefixes: []net.IPNet{cidr(t, c.exclude)},
+		}
+		err := cfg.validate()
+		if ok := err == nil; ok != c.ok {
+			t.Errorf("include %s, exclude %s: got %v", c.include, c.exclude, err)
+		}
+	}
+}
+
+func TestValidateSession(t *testing.T) {
+	s := session.Session{
+		ServerVIP:  net.ParseIP("10.10.0.1"),
+		DNSServers: []net.IP{net.ParseIP("10.0.0.243")},
+	}
+	cases := []struct {
+		exclude string
+		ok      bool
+	}{
+		{"192.168.0.0/16", true},
+		{"10.10.0.0/16", false},
+		{"10.0.0.243/32", false},
+	}
+	for _, c := range cases {
+		cfg := Config{ExcludePrefixes: []net.IPNet{cidr(t, c.exclude)}}
+		err := cfg.validateSession(s)
+		if ok := err == nil; ok != c.ok {
+			t.Errorf("exclude %s: got %v", c.exclude, err)
+		}
+	}
+}
+
+func TestBlackholeRoutesOnlyCoverIncludes(t *testing.T) {
+	cfg := Config{IncludePrefixes: []net.IPNet{cidr(t, "10.0.0.0/8"), cidr(t, "fd00::/8")}}
+	rs := cfg.v4BlackholeRoutes()
+	if len(rs) != 1 || rs[0].Dst.String() != "10.0.0.0/8" {
+		t.Errorf("got %v, want just a blackhole for 10.0.0.0/8", rs)
+	}
+
+	rs = Config{}.v4BlackholeRoutes()
+	if len(rs) != 1 || rs[0].Dst.String() != "0.0.0.0/0" {
+		t.Errorf("got %v, want a default blackhole", rs)
+	}
+}
@@ -0,0 +1,82 @@
+package link
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+// Returns a dialer whose sockets (including those used for DNS lookups) carry
+// cfg's FwMark. Like the wg device's own traffic, connections made with it
+// skip the invert rule and use the main table, so they reach the outside even
+// while the tunnel is down and the blackhole rule is still in place.
+//
+// If nameservers is set and returns any, lookups go to those (in turn) instead
+// of the ones in /etc/resolv.conf, which may only be reachable through the
+// tunnel.
+func Dialer(cfg Config, nameservers func() []net.IP) *net.Dialer {
+	fwMark := cfg.fwMark()
+	d := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return markSocket(c, fwMark)
+		},
+	}
+
+	var next uint32
+	d.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if nameservers != nil {
+				if ns := nameservers(); len(ns) > 0 {
+					ip := ns[int(atomic.AddUint32(&next, 1)-1)%len(ns)]
+					addr = net.JoinHostPort(ip.String(), "53")
+				}
+			}
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	return d
+}
+
+func markSocket(c syscall.RawConn, fwMark int) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(
+			int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, fwMark)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Returns a dial func whose sockets are bound to the link (and made in its
+// netns), so their traffic goes through the tunnel however (and whether) it is
+// steered, and fails while the link is down.
+func (l Link) DialFunc(cfg Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return bindToDevice(c, string(l))
+		},
+	}
+	return func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+		err = inNetns(cfg.Netns, func() (err error) {
+			conn, err = d.DialContext(ctx, network, addr)
+			return
+		})
+		return
+	}
+}
+
+func bindToDevice(c syscall.RawConn, dev string) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptString(
+			int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, dev)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package link
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+const dnsPort = 53
+
+// Sends all DNS traffic (UDP and TCP port 53) to our table, even if it is
+// marked or would otherwise be exempted by a more specific route in main. When
+// steering, only the steered traffic's DNS is caught.
+// With the tunnel up DNS can only leave through it (where the session's DNS
+// servers are), and with it down DNS is blocked along with everything else.
+//
+// Our own marked sockets are not exempt, so lookups made with Dialer only
+// work while the tunnel is up.
+//
+// The guard isn't part of Sync and is left in place by CloseAndBlock, but is
+// removed by Stop and Close (or FlushDNSGuard).
+func SyncDNSGuard(cfg Config) (did bool, err error) {
+	if cfg.Netns != "" {
+		// DNS can't go anywhere but the tunnel anyway.
+		return
+	}
+	for _, family := range families {
+		var didFamily bool
+		didFamily, err = cfg.syncDNSGuardForFamily(family)
+		if err != nil {
+			err = fmt.Errorf("error syncing DNS guard rule: %w", err)
+			return
+		}
+		did = did || didFamily
+	}
+	return
+}
+
+func (c Config) syncDNSGuardForFamily(family int) (did bool, err error) {
+	allRules, err := netlink.RuleList(family)
+	if err != nil {
+		err = fmt.Errorf("error getting routing rules: %w", err)
+		return
+	}
+
+	// The guard only works if it is looked at before the exemptions.
+	inFront := true
+	for _, g := range allRules {
+		if !c.isDNSGuardRule(g) {
+			continue
+		}
+		for _, e := range allRules {
+			if c.isLocalExemption(e) && g.Priority >= e.Priority {
+				inFront = false
+			}
+		}
+	}
+
+	return syncRuleSet(allRules, c.dnsGuardRules(family), !inFront)
+}
+
+// Removes the DNS guard, leaving the rest of the link alone.
+func FlushDNSGuard(cfg Config) error {
+	if cfg.Netns != "" {
+		return nil
+	}
+	for _, family := range families {
+		allRules, err := netlink.RuleList(family)
+		if err != nil {
+			return fmt.Errorf("error getting routing rules: %w", err)
+		}
+		for _, r := range allRules {
+			if !cfg.isDNSGuardRule(r) {
+				continue
+			}
+			if err := netlink.RuleDel(&r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
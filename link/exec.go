@@ -0,0 +1,27 @@
+package link
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/vishvananda/netns"
+)
+
+// Moves the calling goroutine's thread into the given network namespace for
+// good (e.g. to exec something there). The thread stays locked, so it is
+// thrown away with the goroutine rather than reused.
+func EnterNetns(name string) error {
+	runtime.LockOSThread()
+
+	ns, err := openNetns(name)
+	if err != nil {
+		return fmt.Errorf("error opening netns %q: %w", name, err)
+	}
+	defer ns.Close()
+
+	err = netns.Set(ns)
+	if err != nil {
+		return fmt.Errorf("error entering netns %q: %w", name, err)
+	}
+	return nil
+}
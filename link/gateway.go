@@ -0,0 +1,228 @@
+package link
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
+// Where each link in gateway mode remembers what IP forwarding was set to
+// before any of them turned it on, which also tells flushGateway there's
+// something to undo. Forwarding is global, so it's only put back once the last
+// of them is gone. It's in /run since the setting doesn't outlive a reboot
+// either.
+const (
+	forwardingStateDir = "/run/piad"
+	forwardingStateExt = ".ip_forward"
+)
+
+func (l Link) forwardingStatePath() string {
+	return filepath.Join(forwardingStateDir, string(l)+forwardingStateExt)
+}
+
+// The other links' saved settings in dir.
+func otherForwardingStates(dir, self string) ([]string, error) {
+	ps, err := filepath.Glob(filepath.Join(dir, "*"+forwardingStateExt))
+	if err != nil {
+		return nil, err
+	}
+	var others []string
+	for _, p := range ps {
+		if p != self {
+			others = append(others, p)
+		}
+	}
+	return others, nil
+}
+
+// The setting from before any link in dir turned forwarding on: the one
+// another link saved, or cur if there are none.
+func originalForwarding(dir, self string, cur []byte) ([]byte, error) {
+	others, err := otherForwardingStates(dir, self)
+	if err != nil || len(others) == 0 {
+		return cur, err
+	}
+	return ioutil.ReadFile(others[0])
+}
+
+// Our nftables table, which holds just the masquerade rule.
+func (l Link) natTable() *nftables.Table {
+	return &nftables.Table{
+		Name:   "piad-" + string(l),
+		Family: nftables.TableFamilyIPv4,
+	}
+}
+
+// Turns on IP forwarding and masquerades traffic leaving the link so that
+// forwarded clients (e.g. those steered in by SteerSources) use the session's
+// address.
+func (l Link) syncGateway() (did bool, err error) {
+	didForwarding, err := l.enableForwarding()
+	if err != nil {
+		err = fmt.Errorf("error enabling IP forwarding: %w", err)
+		return
+	}
+	did = did || didForwarding
+
+	didNAT, err := l.syncNAT()
+	if err != nil {
+		err = fmt.Errorf("error syncing masquerade rule: %w", err)
+		return
+	}
+	did = did || didNAT
+
+	return
+}
+
+func (l Link) enableForwarding() (did bool, err error) {
+	b, err := ioutil.ReadFile(ipForwardPath)
+	if err != nil {
+		return
+	}
+
+	// Keep what an earlier run saved, since that's the original setting.
+	_, err = os.Stat(l.forwardingStatePath())
+	switch {
+	case os.IsNotExist(err):
+		var orig []byte
+		orig, err = originalForwarding(forwardingStateDir, l.forwardingStatePath(), b)
+		if err != nil {
+			return
+		}
+		err = os.MkdirAll(forwardingStateDir, 0755)
+		if err != nil {
+			return
+		}
+		err = ioutil.WriteFile(l.forwardingStatePath(), orig, 0644)
+		if err != nil {
+			return
+		}
+	case err != nil:
+		return
+	}
+
+	if string(bytes.TrimSpace(b)) == "1" {
+		return
+	}
+
+	did = true
+	err = ioutil.WriteFile(ipForwardPath, []byte("1\n"), 0644)
+	return
+}
+
+func (l Link) syncNAT() (did bool, err error) {
+	c := &nftables.Conn{}
+
+	ts, err := c.ListTables()
+	if err != nil {
+		return
+	}
+	t := l.natTable()
+	for _, existing := range ts {
+		if existing.Name == t.Name && existing.Family == t.Family {
+			return
+		}
+	}
+
+	did = true
+	c.AddTable(t)
+	ch := c.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Table:    t,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+	c.AddRule(&nftables.Rule{
+		Table: t,
+		Chain: ch,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     ifname(string(l)),
+			},
+			&expr.Masq{},
+		},
+	})
+	err = c.Flush()
+	return
+}
+
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+// Undoes syncGateway, only turning IP forwarding back off if it was off before
+// and no other link is still using it. Unless cfg.Gateway is set, nftables is
+// left alone if there's no sign gateway mode was used, so hosts without it (or
+// without nf_tables) are fine.
+func (l Link) flushGateway(cfg Config) error {
+	orig, err := ioutil.ReadFile(l.forwardingStatePath())
+	saved := err == nil
+	switch {
+	case os.IsNotExist(err):
+		if !cfg.Gateway {
+			return nil
+		}
+	case err != nil:
+		return err
+	}
+
+	if err := l.flushNAT(); err != nil {
+		return err
+	}
+
+	if !saved {
+		return nil
+	}
+	others, err := otherForwardingStates(forwardingStateDir, l.forwardingStatePath())
+	if err != nil {
+		return err
+	}
+	if len(others) == 0 {
+		err = ioutil.WriteFile(ipForwardPath, orig, 0644)
+		if err != nil {
+			return fmt.Errorf("error restoring IP forwarding: %w", err)
+		}
+	}
+	return os.Remove(l.forwardingStatePath())
+}
+
+func (l Link) flushNAT() error {
+	c := &nftables.Conn{}
+	ts, err := c.ListTables()
+	switch {
+	case isNoNFTables(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("error listing nftables tables: %w", err)
+	}
+	t := l.natTable()
+	for _, existing := range ts {
+		if existing.Name == t.Name && existing.Family == t.Family {
+			c.DelTable(t)
+			if err := c.Flush(); err != nil && !isNoNFTables(err) {
+				return fmt.Errorf("error deleting masquerade rule: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Whether err means there's no nf_tables (or no table) to clean up.
+func isNoNFTables(err error) bool {
+	return errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EOPNOTSUPP)
+}
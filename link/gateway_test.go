@@ -0,0 +1,54 @@
+package link
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOriginalForwardingIsShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "piad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "wg0"+forwardingStateExt)
+	b := filepath.Join(dir, "wg1"+forwardingStateExt)
+
+	// wg0 is the first, so it saves forwarding as it found it.
+	orig, err := originalForwarding(dir, a, []byte("0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(orig) != "0\n" {
+		t.Fatalf("got %q for the first link, want the current setting", orig)
+	}
+	if err := ioutil.WriteFile(a, orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// wg1 finds forwarding on (thanks to wg0) but saves what wg0 did.
+	orig, err = originalForwarding(dir, b, []byte("1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(orig) != "0\n" {
+		t.Errorf("got %q for the second link, want the first link's %q", orig, "0\n")
+	}
+	if err := ioutil.WriteFile(b, orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither may turn forwarding off while the other is around.
+	for _, self := range []string{a, b} {
+		others, err := otherForwardingStates(dir, self)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(others) != 1 || others[0] == self {
+			t.Errorf("%s: got other links %v", self, others)
+		}
+	}
+}
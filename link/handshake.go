@@ -9,7 +9,15 @@ import (
 
 var ErrNeedsSync = errors.New("device needs sync")
 
-func (l Link) LastHandshake() (t time.Time, err error) {
+func (l Link) LastHandshake(cfg Config) (t time.Time, err error) {
+	err = inNetns(cfg.Netns, func() (err error) {
+		t, err = l.lastHandshake()
+		return
+	})
+	return
+}
+
+func (l Link) lastHandshake() (t time.Time, err error) {
 	cli, err := wgctrl.New()
 	if err != nil {
 		return
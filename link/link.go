@@ -2,6 +2,7 @@ package link
 
 import (
 	"errors"
+	"fmt"
 	"os"
 
 	"github.com/vishvananda/netlink"
@@ -12,13 +13,22 @@ import (
 
 type Link string
 
-func (l Link) Start(sk session.SecretKey) error {
-	err := netlink.LinkAdd(l.toNetlinkLink())
-	if err != nil && !errors.Is(err, os.ErrExist) {
-		return err
+func (l Link) Start(cfg Config, sk session.SecretKey) error {
+	if cfg.Netns != "" {
+		err := l.createInNetns(cfg.Netns)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := netlink.LinkAdd(l.toNetlinkLink())
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
 	}
 
-	return l.setKey(sk)
+	return inNetns(cfg.Netns, func() error {
+		return l.setKey(sk)
+	})
 }
 
 func (l Link) toNetlinkLink() *netlink.Wireguard {
@@ -37,5 +47,46 @@ func (l Link) setKey(sk session.SecretKey) error {
 	defer c.Close()
 
 	wk := wgtypes.Key(sk)
+
+	// Leave a device that's already using the key alone (e.g. one adopted
+	// from a previous run).
+	if dev, err := c.Device(string(l)); err == nil && dev.PrivateKey == wk {
+		return nil
+	}
+
 	return c.ConfigureDevice(string(l), wgtypes.Config{PrivateKey: &wk})
 }
+
+// Switches the device over to a new key and the session registered for it in
+// a single configuration change, so the old peer stays up until the new one
+// takes its place.
+func (l Link) Rekey(cfg Config, sk session.SecretKey, s session.Session) error {
+	return inNetns(cfg.Netns, func() error {
+		return l.rekey(cfg, sk, s)
+	})
+}
+
+func (l Link) rekey(cfg Config, sk session.SecretKey, s session.Session) error {
+	c, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	nl, err := netlink.LinkByName(string(l))
+	if err != nil {
+		return err
+	}
+
+	dc := devConfig(cfg, s)
+	wk := wgtypes.Key(sk)
+	dc.PrivateKey = &wk
+
+	err = c.ConfigureDevice(string(l), dc)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to configure wg device %q: %w", string(l), err)
+	}
+
+	return l.applyLinkState(nl, s)
+}
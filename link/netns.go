@@ -0,0 +1,117 @@
+package link
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Whether name (as in Config.Netns) is a path to a namespace rather than the
+// name of one made with "ip netns add".
+func IsNetnsPath(name string) bool {
+	return strings.Contains(name, "/")
+}
+
+// Opens the namespace with the given name or at the given path.
+func openNetns(name string) (netns.NsHandle, error) {
+	if IsNetnsPath(name) {
+		return netns.GetFromPath(name)
+	}
+	return netns.GetFromName(name)
+}
+
+// Runs f on a thread in the given network namespace, or just runs it if name
+// is empty. Netlink and wgctrl sockets opened by f belong to that namespace.
+func inNetns(name string, f func() error) error {
+	if name == "" {
+		return f()
+	}
+
+	runtime.LockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("error getting current netns: %w", err)
+	}
+	defer orig.Close()
+
+	ns, err := openNetns(name)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("error opening netns %q: %w", name, err)
+	}
+	defer ns.Close()
+
+	err = netns.Set(ns)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("error entering netns %q: %w", name, err)
+	}
+	defer func() {
+		// If the thread can't be put back, leaving it locked makes the
+		// runtime throw it away with the goroutine.
+		if netns.Set(orig) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+
+	return f()
+}
+
+// Creates the device in the current namespace, where its UDP socket stays, and
+// then moves it into the given one. A device already in the namespace (e.g.
+// from a previous run) is left alone.
+func (l Link) createInNetns(name string) error {
+	var exists bool
+	err := inNetns(name, func() error {
+		_, err := netlink.LinkByName(string(l))
+		exists = err == nil
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil || exists {
+		return err
+	}
+
+	err = netlink.LinkAdd(l.toNetlinkLink())
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	nl, err := netlink.LinkByName(string(l))
+	if err != nil {
+		return err
+	}
+
+	ns, err := openNetns(name)
+	if err != nil {
+		return fmt.Errorf("error opening netns %q: %w", name, err)
+	}
+	defer ns.Close()
+
+	err = netlink.LinkSetNsFd(nl, int(ns))
+	if err != nil {
+		return fmt.Errorf("error moving dev %q to netns %q: %w", string(l), name, err)
+	}
+
+	// A fresh namespace's loopback starts out down.
+	return inNetns(name, func() error {
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(lo)
+	})
+}
+
+func isNotFound(err error) bool {
+	var lnf netlink.LinkNotFoundError
+	return errors.As(err, &lnf) || errors.Is(err, os.ErrNotExist)
+}
@@ -0,0 +1,309 @@
+package link
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"go.jonnrb.io/piad/session"
+)
+
+// What goes in the wg peer's AllowedIPs: everything, or with IncludePrefixes
+// just those and the session's gateway and DNS servers.
+func (c Config) allowedIPs(s session.Session) []net.IPNet {
+	if len(c.IncludePrefixes) == 0 {
+		return []net.IPNet{*defaultDst(netlink.FAMILY_V4)}
+	}
+
+	var ns []net.IPNet
+	for _, n := range c.IncludePrefixes {
+		if ipFamily(n.IP) == netlink.FAMILY_V4 {
+			ns = append(ns, n)
+		}
+	}
+	ns = append(ns, hostNet(s.ServerVIP))
+	for _, ip := range s.DNSServers {
+		if ip.To4() != nil {
+			ns = append(ns, hostNet(ip))
+		}
+	}
+	return ns
+}
+
+func hostNet(ip net.IP) net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func ipNetsEqual(a, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	as := make([]string, len(a))
+	bs := make([]string, len(b))
+	for i := range a {
+		as[i] = a[i].String()
+		bs[i] = b[i].String()
+	}
+	sort.Strings(as)
+	sort.Strings(bs)
+	for i := range as {
+		if as[i] != bs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The routes our v4 table should have: a link route to the server's gateway,
+// routes through it for everything (or just IncludePrefixes and the session's
+// DNS servers), and throw routes for ExcludePrefixes so that lookups for them
+// fall through to the rules after ours. Unless in a netns, the routes through
+// the gateway are backed by blackholes so that traffic steered into our table
+// can't fall through to the exempt table's default route if the device goes
+// away (taking its routes with it).
+func (c Config) v4Routes(s session.Session, linkIndex int) []netlink.Route {
+	rs := []netlink.Route{{
+		LinkIndex: linkIndex,
+		Dst:       &net.IPNet{IP: s.ServerVIP, Mask: net.CIDRMask(32, 32)},
+		Table:     c.table(),
+		Scope:     netlink.SCOPE_LINK,
+	}}
+
+	via := func(n net.IPNet) {
+		rs = append(rs, netlink.Route{Dst: &n, Gw: s.ServerVIP, Table: c.table()})
+	}
+	if len(c.IncludePrefixes) == 0 {
+		via(*defaultDst(netlink.FAMILY_V4))
+	} else {
+		for _, n := range c.IncludePrefixes {
+			if ipFamily(n.IP) == netlink.FAMILY_V4 {
+				via(n)
+			}
+		}
+		for _, ip := range s.DNSServers {
+			if ip.To4() != nil {
+				via(hostNet(ip))
+			}
+		}
+	}
+
+	if c.Netns == "" {
+		rs = append(rs, c.v4BlackholeRoutes()...)
+	}
+	return append(rs, c.throwRoutes(netlink.FAMILY_V4)...)
+}
+
+// Blackholes for everything (or just IncludePrefixes) with a metric that puts
+// them behind the routes through the gateway.
+func (c Config) v4BlackholeRoutes() []netlink.Route {
+	var rs []netlink.Route
+	blackhole := func(n net.IPNet) {
+		rs = append(rs, netlink.Route{
+			Dst:      &n,
+			Table:    c.table(),
+			Type:     syscall.RTN_BLACKHOLE,
+			Priority: blackholeMetric,
+		})
+	}
+	if len(c.IncludePrefixes) == 0 {
+		blackhole(*defaultDst(netlink.FAMILY_V4))
+	} else {
+		for _, n := range c.IncludePrefixes {
+			if ipFamily(n.IP) == netlink.FAMILY_V4 {
+				blackhole(n)
+			}
+		}
+	}
+	return rs
+}
+
+const blackholeMetric = 65535
+
+// Sessions don't come with a v6 address, so v6 traffic that hits our table
+// (all of it, or with IncludePrefixes just the included prefixes) is refused
+// instead of being allowed to go around the tunnel.
+func (c Config) v6Routes() []netlink.Route {
+	var rs []netlink.Route
+	if len(c.IncludePrefixes) == 0 {
+		rs = append(rs, c.v6UnreachableRoute())
+	} else {
+		for i := range c.IncludePrefixes {
+			n := c.IncludePrefixes[i]
+			if ipFamily(n.IP) == netlink.FAMILY_V6 {
+				rs = append(rs, netlink.Route{
+					Dst:   &n,
+					Table: c.table(),
+					Type:  syscall.RTN_UNREACHABLE,
+				})
+			}
+		}
+	}
+	return append(rs, c.throwRoutes(netlink.FAMILY_V6)...)
+}
+
+func (c Config) v6UnreachableRoute() netlink.Route {
+	return netlink.Route{
+		Dst:   defaultDst(netlink.FAMILY_V6),
+		Table: c.table(),
+		Type:  syscall.RTN_UNREACHABLE,
+	}
+}
+
+func (c Config) throwRoutes(family int) []netlink.Route {
+	var rs []netlink.Route
+	for i := range c.ExcludePrefixes {
+		n := c.ExcludePrefixes[i]
+		if ipFamily(n.IP) == family {
+			rs = append(rs, netlink.Route{
+				Dst:   &n,
+				Table: c.table(),
+				Type:  syscall.RTN_THROW,
+			})
+		}
+	}
+	return rs
+}
+
+func (l Link) syncRoutingTables(cfg Config, s session.Session) (did bool, err error) {
+	nl, err := netlink.LinkByName(string(l))
+	if err != nil {
+		return
+	}
+
+	linkIndex := nl.Attrs().Index
+
+	didV4, err := cfg.syncRoutingTable(netlink.FAMILY_V4, linkIndex, cfg.v4Routes(s, linkIndex))
+	if err != nil {
+		err = fmt.Errorf("could not sync v4 routing table: %w", err)
+		return
+	}
+	did = did || didV4
+
+	didV6, err := cfg.syncRoutingTable(netlink.FAMILY_V6, linkIndex, cfg.v6Routes())
+	if err != nil {
+		err = fmt.Errorf("could not sync v6 routing table: %w", err)
+		return
+	}
+	did = did || didV6
+
+	return
+}
+
+func (c Config) syncRoutingTable(family, linkIndex int, want []netlink.Route) (did bool, err error) {
+	rs, err := c.getOurRoutingTable(family)
+	if err != nil {
+		err = fmt.Errorf("could not get routing table: %w", err)
+		return
+	}
+
+	// Routes to a wanted destination (and metric) are replaced in place (so
+	// the default route never goes missing when the gateway changes), so
+	// only those to other destinations are unknown.
+	var unknownRoutes []netlink.Route
+	for _, r := range rs {
+		if !hasRouteLike(want, r) && c.ownsRoute(r, linkIndex) {
+			unknownRoutes = append(unknownRoutes, r)
+		}
+	}
+
+	for _, w := range want {
+		if hasRoute(rs, w) {
+			continue
+		}
+		did = true
+		err = netlink.RouteReplace(&w)
+		if err != nil {
+			err = fmt.Errorf("could not add route %v: %w", w, err)
+			return
+		}
+	}
+
+	didPrune, err := pruneUnknownRoutes(unknownRoutes)
+	if err != nil {
+		err = fmt.Errorf("could not prune unknown routes: %w", err)
+		return
+	}
+	did = did || didPrune
+
+	return
+}
+
+// Reports whether our table has all of want.
+func (c Config) hasRoutes(family int, want []netlink.Route) (bool, error) {
+	rs, err := c.getOurRoutingTable(family)
+	if err != nil {
+		return false, err
+	}
+	for _, w := range want {
+		if !hasRoute(rs, w) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Whether r is ours to remove. In a namespace, our table is main, so routes
+// through other links (e.g. a veth for reaching a container) are left alone.
+func (c Config) ownsRoute(r netlink.Route, linkIndex int) bool {
+	return c.Netns == "" || r.Type != syscall.RTN_UNICAST ||
+		(linkIndex != 0 && r.LinkIndex == linkIndex)
+}
+
+func hasRoute(rs []netlink.Route, want netlink.Route) bool {
+	for _, r := range rs {
+		if routeMatches(want, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether rs has a route that r would replace.
+func hasRouteLike(rs []netlink.Route, r netlink.Route) bool {
+	for _, want := range rs {
+		if sameRouteKey(want, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether r has want's destination and metric. The metric is only compared if
+// want has one, since the kernel gives v6 routes a default one.
+func sameRouteKey(want, r netlink.Route) bool {
+	return ipNetEqual(r.Dst, want.Dst) &&
+		(want.Priority == 0 || r.Priority == want.Priority)
+}
+
+// Compares the parts of routes we set. The link is only compared if want has
+// one.
+func routeMatches(want, r netlink.Route) bool {
+	wantType := want.Type
+	if wantType == 0 {
+		wantType = syscall.RTN_UNICAST
+	}
+	return sameRouteKey(want, r) &&
+		r.Gw.Equal(want.Gw) &&
+		r.Type == wantType &&
+		(want.LinkIndex == 0 || r.LinkIndex == want.LinkIndex)
+}
+
+func pruneUnknownRoutes(unknownRoutes []netlink.Route) (did bool, err error) {
+	if len(unknownRoutes) == 0 {
+		return
+	}
+
+	did = true
+	for _, r := range unknownRoutes {
+		err = netlink.RouteDel(&r)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,55 @@
+package link
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"go.jonnrb.io/piad/session"
+)
+
+func TestV4RoutesBackedByBlackholes(t *testing.T) {
+	s := session.Session{ServerVIP: net.ParseIP("10.10.0.1").To4()}
+
+	cases := []struct {
+		cfg  Config
+		want []string
+	}{
+		{Config{SteerUIDs: []UIDRange{{1000, 1999}}}, []string{"0.0.0.0/0"}},
+		{Config{IncludePrefixes: []net.IPNet{cidr(t, "10.0.0.0/8")}}, []string{"10.0.0.0/8"}},
+		{Config{Netns: "vpn"}, nil},
+	}
+	for _, c := range cases {
+		var got []string
+		for _, r := range c.cfg.v4Routes(s, 1) {
+			if r.Type != syscall.RTN_BLACKHOLE {
+				continue
+			}
+			if r.Priority != blackholeMetric {
+				t.Errorf("%+v: blackhole %v has metric %d", c.cfg, r.Dst, r.Priority)
+			}
+			got = append(got, r.Dst.String())
+		}
+		if len(got) != len(c.want) || (len(got) > 0 && got[0] != c.want[0]) {
+			t.Errorf("%+v: got blackholes %v, want %v", c.cfg, got, c.want)
+		}
+	}
+}
+
+func TestRouteMatchesMetric(t *testing.T) {
+	via := netlink.Route{Dst: defaultDst(netlink.FAMILY_V4), Gw: net.ParseIP("10.10.0.1")}
+	blackhole := Config{}.v4BlackholeRoutes()[0]
+
+	if routeMatches(via, blackhole) || routeMatches(blackhole, via) {
+		t.Error("a blackhole shouldn't stand in for the route through the gateway")
+	}
+	gone := blackhole
+	gone.Priority = 0
+	if routeMatches(blackhole, gone) || sameRouteKey(blackhole, gone) {
+		t.Error("a blackhole with another metric isn't ours")
+	}
+	if !routeMatches(blackhole, blackhole) {
+		t.Error("expected the blackhole to match itself")
+	}
+}
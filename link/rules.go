@@ -0,0 +1,269 @@
+package link
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Each family gets a blackhole rule per selector sending the traffic we tunnel
+// to our table, in front of those an exemption per selector letting it use
+// the non-default routes in the exempt table, and optionally (see
+// SyncDNSGuard) the DNS guard in front of everything.
+//
+// Since every rule carries our selector, another instance's rules never look
+// like ours.
+
+func newRule(family int) netlink.Rule {
+	r := *netlink.NewRule()
+	r.Family = family
+	return r
+}
+
+func (c Config) steered() bool {
+	return c.SteerMark != 0 || len(c.SteerSources) != 0 || len(c.SteerUIDs) != 0
+}
+
+// The traffic we tunnel, as rules without an action.
+func (c Config) selectors(family int) (rs []netlink.Rule) {
+	switch {
+	case c.SteerMark != 0:
+		r := newRule(family)
+		r.Mark = uint32(c.SteerMark)
+		rs = append(rs, r)
+	case len(c.SteerSources) != 0:
+		for i := range c.SteerSources {
+			src := c.SteerSources[i]
+			if ipFamily(src.IP) != family {
+				continue
+			}
+			r := newRule(family)
+			r.Src = &src
+			rs = append(rs, r)
+		}
+	case len(c.SteerUIDs) != 0:
+		for _, u := range c.SteerUIDs {
+			r := newRule(family)
+			r.UIDRange = netlink.NewRuleUIDRange(u.Start, u.End)
+			rs = append(rs, r)
+		}
+	case c.Netns != "":
+		// The namespace is ours, so there's nothing to select.
+	default:
+		// Everything but the wg device's own traffic (and our Dialer's).
+		r := newRule(family)
+		r.Mark = uint32(c.fwMark())
+		r.Invert = true
+		rs = append(rs, r)
+	}
+	return
+}
+
+func (c Config) blackholeRules(family int) []netlink.Rule {
+	rs := c.selectors(family)
+	for i := range rs {
+		rs[i].Table = c.table()
+		rs[i].Priority = rulePriority(c.BlackholePriority)
+	}
+	return rs
+}
+
+func (c Config) exemptionRules(family int) []netlink.Rule {
+	rs := c.selectors(family)
+	for i := range rs {
+		rs[i].Table = c.exemptTable()
+		rs[i].SuppressPrefixlen = 0
+		rs[i].Priority = rulePriority(c.ExemptionPriority)
+	}
+	return rs
+}
+
+func (c Config) dnsGuardRules(family int) []netlink.Rule {
+	// Unless we're steering, DNS is caught even if it is marked.
+	rs := []netlink.Rule{newRule(family)}
+	if c.steered() {
+		rs = c.selectors(family)
+	}
+	for i := range rs {
+		rs[i].Table = c.table()
+		rs[i].Dport = netlink.NewRulePortRange(dnsPort, dnsPort)
+		rs[i].Priority = rulePriority(c.DNSGuardPriority)
+	}
+	return rs
+}
+
+func (c Config) isBlackholeRule(r netlink.Rule) bool {
+	return matchesAny(r, c.blackholeRules(r.Family))
+}
+
+func (c Config) isLocalExemption(r netlink.Rule) bool {
+	return matchesAny(r, c.exemptionRules(r.Family))
+}
+
+func (c Config) isDNSGuardRule(r netlink.Rule) bool {
+	return matchesAny(r, c.dnsGuardRules(r.Family))
+}
+
+func (c Config) isOurRule(r netlink.Rule) bool {
+	return c.isBlackholeRule(r) || c.isLocalExemption(r) || c.isDNSGuardRule(r)
+}
+
+// Reports whether our rules are in place, in which case only marked sockets
+// (see Dialer) get around the tunnel.
+func (c Config) HasRules() (bool, error) {
+	if c.Netns != "" {
+		return false, nil
+	}
+	rs, err := netlink.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range rs {
+		if c.isBlackholeRule(r) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func matchesAny(r netlink.Rule, want []netlink.Rule) bool {
+	for _, w := range want {
+		if ruleMatches(w, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compares the parts of rules we set. Priorities are only compared if want has
+// one.
+func ruleMatches(want, r netlink.Rule) bool {
+	return r.Table == want.Table &&
+		r.Mark == want.Mark &&
+		r.Invert == want.Invert &&
+		r.SuppressPrefixlen == want.SuppressPrefixlen &&
+		ipNetEqual(r.Src, want.Src) &&
+		portRangeEqual(r.Dport, want.Dport) &&
+		uidRangeEqual(r.UIDRange, want.UIDRange) &&
+		(want.Priority == -1 || r.Priority == want.Priority)
+}
+
+func ipNetEqual(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.String() == b.String()
+}
+
+func portRangeEqual(a, b *netlink.RulePortRange) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func uidRangeEqual(a, b *netlink.RuleUIDRange) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func ipFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+func (c Config) syncRules() (did bool, err error) {
+	if c.Netns != "" {
+		return
+	}
+	for _, family := range families {
+		var didFamily bool
+		didFamily, err = c.syncRulesForFamily(family)
+		if err != nil {
+			return
+		}
+		did = did || didFamily
+	}
+	return
+}
+
+func (c Config) syncRulesForFamily(family int) (did bool, err error) {
+	allRules, err := netlink.RuleList(family)
+	if err != nil {
+		err = fmt.Errorf("error getting routing rules: %w", err)
+		return
+	}
+
+	// Anything else pointing at our table is left over from a different
+	// config (e.g. a source that isn't steered anymore).
+	for _, r := range allRules {
+		if r.Table != c.table() || c.isOurRule(r) {
+			continue
+		}
+		did = true
+		err = netlink.RuleDel(&r)
+		if err != nil {
+			err = fmt.Errorf("error deleting rule %+v: %w", r, err)
+			return
+		}
+	}
+
+	didBlackholeRules, err := syncRuleSet(allRules, c.blackholeRules(family), false)
+	if err != nil {
+		err = fmt.Errorf("error syncing blackhole rules: %w", err)
+		return
+	}
+	did = did || didBlackholeRules
+
+	// Re-adding the blackhole rules may have put them in front of the
+	// exemptions.
+	didLocalExemptions, err := syncRuleSet(allRules, c.exemptionRules(family), didBlackholeRules)
+	if err != nil {
+		err = fmt.Errorf("error syncing local exemption rules: %w", err)
+		return
+	}
+	did = did || didLocalExemptions
+
+	return
+}
+
+// Adds the rules in want that are missing from allRules. If force is set, the
+// rules are deleted and added again to put them in front of the others.
+func syncRuleSet(allRules, want []netlink.Rule, force bool) (did bool, err error) {
+	var missing []netlink.Rule
+	for _, w := range want {
+		found := false
+		for _, r := range allRules {
+			if !ruleMatches(w, r) {
+				continue
+			}
+			found = true
+			if !force {
+				continue
+			}
+			err = netlink.RuleDel(&r)
+			if err != nil {
+				err = fmt.Errorf("error deleting rule %+v: %w", r, err)
+				return
+			}
+		}
+		if force || !found {
+			missing = append(missing, w)
+		}
+	}
+
+	for _, r := range missing {
+		did = true
+		err = netlink.RuleAdd(&r)
+		if err != nil {
+			err = fmt.Errorf("error adding rule %+v: %w", r, err)
+			return
+		}
+	}
+	return
+}
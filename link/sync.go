@@ -11,37 +11,55 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-const (
-	KeepaliveInterval = 5 * time.Second
-	FwMark            = 1337
-)
+const KeepaliveInterval = 5 * time.Second
+
+func (l Link) Sync(cfg Config, s session.Session) (did bool, err error) {
+	err = inNetns(cfg.Netns, func() (err error) {
+		did, err = l.sync(cfg, s)
+		return
+	})
+	return
+}
 
-func (l Link) Sync(s session.Session) (did bool, err error) {
-	didDev, err := l.syncDev(s)
+func (l Link) sync(cfg Config, s session.Session) (did bool, err error) {
+	err = cfg.validateSession(s)
+	if err != nil {
+		return
+	}
+
+	didDev, err := l.syncDev(cfg, s)
 	if err != nil {
 		err = fmt.Errorf("error syncing wg dev %q: %w", string(l), err)
 		return
 	}
 	did = did || didDev
 
-	didRoutingTables, err := l.syncRoutingTables(s)
+	didRoutingTables, err := l.syncRoutingTables(cfg, s)
 	if err != nil {
 		err = fmt.Errorf("error syncing routing tables: %w", err)
 		return
 	}
 	did = did || didRoutingTables
 
-	didRules, err := syncRules()
+	didRules, err := cfg.syncRules()
 	if err != nil {
 		err = fmt.Errorf("error syncing routing rules: %w", err)
 		return
 	}
 	did = did || didRules
 
+	if cfg.Gateway {
+		didGateway, err := l.syncGateway()
+		if err != nil {
+			return did, err
+		}
+		did = did || didGateway
+	}
+
 	return
 }
 
-func (l Link) syncDev(s session.Session) (did bool, err error) {
+func (l Link) syncDev(cfg Config, s session.Session) (did bool, err error) {
 	cli, err := wgctrl.New()
 	if err != nil {
 		return
@@ -57,7 +75,7 @@ func (l Link) syncDev(s session.Session) (did bool, err error) {
 	}
 
 	applyDev := func() (bool, error) {
-		err := l.applyDev(cli, nl, s)
+		err := l.applyDev(cli, nl, cfg, s)
 		return err == nil, err
 	}
 
@@ -83,11 +101,7 @@ func (l Link) syncDev(s session.Session) (did bool, err error) {
 		return applyDev()
 	}
 
-	if len(p.AllowedIPs) != 1 {
-		return applyDev()
-	}
-
-	if ones, bits := p.AllowedIPs[0].Mask.Size(); bits != 32 && ones != 0 {
+	if !ipNetsEqual(p.AllowedIPs, cfg.allowedIPs(s)) {
 		return applyDev()
 	}
 
@@ -103,6 +117,10 @@ func (l Link) syncDev(s session.Session) (did bool, err error) {
 		return applyDev()
 	}
 
+	if dev.FirewallMark != cfg.fwMark() {
+		return applyDev()
+	}
+
 	// From here on out, if the link state doesn't match, don't touch the wg
 	// config.
 	applyLinkState := func() (bool, error) {
@@ -134,11 +152,21 @@ func udpAddrEqual(a, b *net.UDPAddr) bool {
 	return a.IP.Equal(b.IP) && a.Port == b.Port && a.Zone == b.Zone
 }
 
-func (l Link) applyDev(cli *wgctrl.Client, nl netlink.Link, s session.Session) error {
+func (l Link) applyDev(cli *wgctrl.Client, nl netlink.Link, cfg Config, s session.Session) error {
+	err := cli.ConfigureDevice(string(l), devConfig(cfg, s))
+	if err != nil {
+		return fmt.Errorf(
+			"failed to configure wg device %q: %w", string(l), err)
+	}
+
+	return l.applyLinkState(nl, s)
+}
+
+func devConfig(cfg Config, s session.Session) wgtypes.Config {
 	keepaliveInterval := KeepaliveInterval
-	fwMark := FwMark
+	fwMark := cfg.fwMark()
 
-	err := cli.ConfigureDevice(string(l), wgtypes.Config{
+	return wgtypes.Config{
 		FirewallMark: &fwMark,
 		ReplacePeers: true,
 		Peers: []wgtypes.PeerConfig{{
@@ -146,18 +174,9 @@ func (l Link) applyDev(cli *wgctrl.Client, nl netlink.Link, s session.Session) e
 			Endpoint:                    &s.ServerAddr,
 			PersistentKeepaliveInterval: &keepaliveInterval,
 			ReplaceAllowedIPs:           true,
-			AllowedIPs: []net.IPNet{{
-				IP:   net.ParseIP("0.0.0.0"),
-				Mask: net.CIDRMask(0, 32),
-			}},
+			AllowedIPs:                  cfg.allowedIPs(s),
 		}},
-	})
-	if err != nil {
-		return fmt.Errorf(
-			"failed to configure wg device %q: %w", string(l), err)
 	}
-
-	return l.applyLinkState(nl, s)
 }
 
 func (l Link) applyLinkState(nl netlink.Link, s session.Session) error {
@@ -205,213 +224,28 @@ func (l Link) applyLinkState(nl netlink.Link, s session.Session) error {
 	return nil
 }
 
-func (l Link) syncRoutingTables(s session.Session) (did bool, err error) {
-	rs, err := getOurRoutingTable()
-	if err != nil {
-		err = fmt.Errorf("could not get routing tables: %w", err)
-		return
-	}
-
-	var (
-		existingGatewayStaticRoute *netlink.Route
-		existingDefaultRoute       *netlink.Route
-		unknownRoutes              []netlink.Route
-	)
-	for _, r := range rs {
-		if r.Dst == nil {
-			existingDefaultRoute = &netlink.Route{}
-			*existingDefaultRoute = r
-			continue
-		}
-		ones, bits := r.Dst.Mask.Size()
-		if bits == 32 && ones == 32 && r.Dst.IP.Equal(s.ServerVIP) {
-			existingGatewayStaticRoute = &netlink.Route{}
-			*existingGatewayStaticRoute = r
-			continue
-		}
-		unknownRoutes = append(unknownRoutes, r)
-	}
-
-	didGatewayStatic, err := l.syncGatewayStaticRoute(s, existingGatewayStaticRoute)
-	if err != nil {
-		err = fmt.Errorf(
-			"could not add static route to %s: %w", s.ServerVIP, err)
-		return
-	}
-	did = did || didGatewayStatic
-
-	didDefault, err := syncDefaultRoute(s, existingDefaultRoute)
-	if err != nil {
-		err = fmt.Errorf("could not add default route: %w", err)
-		return
-	}
-	did = did || didDefault
-
-	didPrune, err := pruneUnknownRoutes(unknownRoutes)
-	if err != nil {
-		err = fmt.Errorf("could not prune unknown routes: %w", err)
-		return
-	}
-	did = did || didPrune
-
-	return
-}
-
-func (l Link) syncGatewayStaticRoute(s session.Session, oldGatewayStaticRoute *netlink.Route) (did bool, err error) {
-	if oldGatewayStaticRoute != nil {
-		return
-	}
-
-	nl, err := netlink.LinkByName(string(l))
+func (c Config) getOurRoutingTable(family int) ([]netlink.Route, error) {
+	f := netlink.Route{Table: c.table()}
+	rs, err := netlink.RouteListFiltered(family, &f, netlink.RT_FILTER_TABLE)
 	if err != nil {
-		return
-	}
-
-	gatewayStaticRoute := netlink.Route{
-		LinkIndex: nl.Attrs().Index,
-		Dst: &net.IPNet{
-			IP:   s.ServerVIP,
-			Mask: net.CIDRMask(32, 32),
-		},
-		Table: FwMark,
-		Scope: netlink.SCOPE_LINK,
-	}
-
-	err = netlink.RouteAdd(&gatewayStaticRoute)
-	did = true
-	return
-}
-
-func syncDefaultRoute(s session.Session, oldDefaultRoute *netlink.Route) (did bool, err error) {
-	if oldDefaultRoute != nil && oldDefaultRoute.Gw.Equal(s.ServerVIP) {
-		return
-	}
-
-	defaultRoute := netlink.Route{
-		Gw: s.ServerVIP,
-		Dst: &net.IPNet{
-			IP:   net.ParseIP("0.0.0.0"),
-			Mask: net.CIDRMask(32, 0),
-		},
-		Table: FwMark,
-	}
-
-	if oldDefaultRoute != nil {
-		err = netlink.RouteReplace(&defaultRoute)
-	} else {
-		err = netlink.RouteAdd(&defaultRoute)
-	}
-	did = true
-	return
-}
-
-func pruneUnknownRoutes(unknownRoutes []netlink.Route) (did bool, err error) {
-	if len(unknownRoutes) == 0 {
-		return
+		return nil, err
 	}
 
-	did = true
-	for _, r := range unknownRoutes {
-		err = netlink.RouteDel(&r)
-		if err != nil {
-			return
+	// Default routes come back without a Dst, which netlink needs to figure
+	// out the family when deleting them.
+	for i := range rs {
+		if rs[i].Dst == nil {
+			rs[i].Dst = defaultDst(family)
 		}
 	}
-	return
-}
-
-func getOurRoutingTable() ([]netlink.Route, error) {
-	// The fw mark is also our routing table. Clever eh?
-	f := netlink.Route{Table: FwMark}
-	return netlink.RouteListFiltered(netlink.FAMILY_V4, &f, netlink.RT_FILTER_TABLE)
-}
-
-func syncRules() (did bool, err error) {
-	allRules, err := netlink.RuleList(netlink.FAMILY_V4)
-	if err != nil {
-		err = fmt.Errorf("error getting routing rules: %w", err)
-		return
-	}
-
-	didBlackholeRule, err := syncBlackholeRule(allRules)
-	if err != nil {
-		err = fmt.Errorf("error syncing blackhole rule: %w", err)
-		return
-	}
-	did = did || didBlackholeRule
-
-	didLocalExemption, err := syncLocalExemption(allRules)
-	if err != nil {
-		err = fmt.Errorf("error syncing local exemption rule: %w", err)
-		return
-	}
-	did = did || didLocalExemption
-
-	return
+	return rs, nil
 }
 
-func syncBlackholeRule(allRules []netlink.Rule) (did bool, err error) {
-	for _, r := range allRules {
-		hasMark := r.Mark == FwMark
-		hasTable := r.Table == FwMark
-		hasInvert := r.Invert == true
-
-		switch {
-		case hasMark && hasTable && hasInvert:
-			return
-		case hasMark || hasTable:
-			err = netlink.RuleDel(&r)
-			if err != nil {
-				err = fmt.Errorf("error deleting rule %+v: %w", r, err)
-				return
-			}
-		}
-	}
-
-	did = true
-	r := netlink.Rule{
-		Mark:   FwMark,
-		Table:  FwMark,
-		Invert: true,
-
-		SuppressIfgroup:   -1,
-		SuppressPrefixlen: -1,
-		Priority:          -1,
-		Mask:              -1,
-		Goto:              -1,
-		Flow:              -1,
-	}
-	err = netlink.RuleAdd(&r)
-	if err != nil {
-		err = fmt.Errorf("error adding blackhole rule %+v: %w", r, err)
+func defaultDst(family int) *net.IPNet {
+	if family == netlink.FAMILY_V6 {
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
 	}
-	return
+	return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
 }
 
-func syncLocalExemption(allRules []netlink.Rule) (did bool, err error) {
-	const mainTable = 254
-
-	for _, r := range allRules {
-		hasTable := r.Table == mainTable
-		hasSuppressPrefixLen := r.SuppressPrefixlen == 0
-
-		if hasTable && hasSuppressPrefixLen {
-			return
-		}
-	}
-
-	did = true
-	r := netlink.Rule{
-		Table:             mainTable,
-		SuppressPrefixlen: 0,
-
-		SuppressIfgroup: -1,
-		Priority:        -1,
-		Mark:            -1,
-		Mask:            -1,
-		Goto:            -1,
-		Flow:            -1,
-	}
-	err = netlink.RuleAdd(&r)
-	return
-}
+var families = []int{netlink.FAMILY_V4, netlink.FAMILY_V6}
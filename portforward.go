@@ -0,0 +1,139 @@
+package piad
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"go.jonnrb.io/piad/internal/atomicfile"
+	"go.jonnrb.io/piad/session"
+)
+
+const (
+	portForwardTimeout    = 30 * time.Second
+	portForwardRetryDelay = time.Minute
+)
+
+type portForwardUpdate struct {
+	// The server VIP the port was bound on, so that a result for a server we
+	// moved away from in the meantime is dropped.
+	vip net.IP
+	pf  *session.PortForward // Set if a new port was gotten.
+	err error
+}
+
+// Gets a forwarded port if we don't have one and keeps it bound. Failures are
+// only logged since the tunnel is still useful without a forwarded port.
+//
+// Like refreshServerList, binding happens in the background (so a slow server
+// doesn't hold up the handshake watchdog) and the result is picked up on a
+// later call.
+func (s *controllerState) syncPortForward(ctx context.Context) {
+	if !s.ctlr.PortForward {
+		return
+	}
+
+	select {
+	case u := <-s.portForwardUpdates:
+		s.applyPortForwardUpdate(u)
+	default:
+	}
+
+	now := time.Now()
+	if s.bindingPort || now.Before(s.nextPortForward) {
+		return
+	}
+	s.bindingPort = true
+
+	srv, sn, pf := s.srv, s.sn, s.pf
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, portForwardTimeout)
+		defer cancel()
+		s.portForwardUpdates <- s.bindPort(ctx, srv, sn, pf, now)
+	}()
+}
+
+func (s *controllerState) applyPortForwardUpdate(u portForwardUpdate) {
+	s.bindingPort = false
+	if !u.vip.Equal(s.sn.ServerVIP) {
+		return
+	}
+	if u.pf != nil {
+		s.pf = u.pf
+		s.pfPublished = false
+		s.saveState()
+	}
+
+	now := time.Now()
+	if u.err != nil {
+		log.Printf("error forwarding port: %v", u.err)
+		s.nextPortForward = now.Add(portForwardRetryDelay)
+		return
+	}
+	s.nextPortForward = now.Add(session.BindPortInterval)
+
+	// Only a bound port is worth handing out.
+	if !s.pfPublished {
+		log.Printf("forwarding port %d (until %v)", s.pf.Port, s.pf.ExpiresAt)
+		if err := s.publishPort(s.pf.Port); err != nil {
+			log.Printf("error publishing port %d: %v", s.pf.Port, err)
+			return
+		}
+		s.pfPublished = true
+	}
+}
+
+// Binds pf (or a new port if it is nil or expiring) on srv. Only touches
+// things that are safe to use off the sync loop.
+func (s *controllerState) bindPort(ctx context.Context, srv session.Server, sn session.Session, pf *session.PortForward, now time.Time) (u portForwardUpdate) {
+	u.vip = sn.ServerVIP
+	if pf == nil || pf.ExpiresAt.Before(now.Add(session.BindPortInterval)) {
+		tok, err := s.tokens.Token(ctx)
+		if err != nil {
+			u.err = fmt.Errorf("error getting token: %w", err)
+			return
+		}
+
+		// The port forwarding API is only reachable through the tunnel, so
+		// don't use marked sockets.
+		newPF, err := srv.GetSignature(ctx, s.tunnelCli, tok, sn)
+		if err != nil {
+			u.err = fmt.Errorf("error getting signature: %w", err)
+			return
+		}
+		pf = &newPF
+		u.pf = pf
+	}
+
+	err := srv.BindPort(ctx, s.tunnelCli, sn, *pf)
+	if err != nil {
+		u.err = fmt.Errorf("error binding port %d: %w", pf.Port, err)
+	}
+	return
+}
+
+func (s *controllerState) publishPort(port uint16) error {
+	if s.ctlr.PortFile == "" {
+		return nil
+	}
+
+	err := atomicfile.WriteFile(
+		s.ctlr.PortFile, []byte(fmt.Sprintf("%d\n", port)), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing port file: %w", err)
+	}
+	return nil
+}
+
+func (s *controllerState) unpublishPort() {
+	if s.ctlr.PortFile == "" {
+		return
+	}
+	err := os.Remove(s.ctlr.PortFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("error removing port file: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package piad
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.jonnrb.io/piad/session"
+)
+
+func TestPortPublishedOnFirstGoodBind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "piad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vip := net.ParseIP("10.10.0.1")
+	s := &controllerState{
+		ctlr: Controller{PortForward: true, PortFile: filepath.Join(dir, "port")},
+		sn:   session.Session{ServerVIP: vip},
+	}
+	pf := &session.PortForward{Port: 4242, ExpiresAt: time.Now().Add(24 * time.Hour)}
+
+	// Got a signature, but the bind failed.
+	s.applyPortForwardUpdate(portForwardUpdate{vip: vip, pf: pf, err: errors.New("nope")})
+	if _, err := os.Stat(s.ctlr.PortFile); !os.IsNotExist(err) {
+		t.Fatalf("port file written before a bind worked: %v", err)
+	}
+	if s.pfPublished {
+		t.Fatal("port marked published before a bind worked")
+	}
+
+	// A later bind of the same port works.
+	s.applyPortForwardUpdate(portForwardUpdate{vip: vip})
+	b, err := ioutil.ReadFile(s.ctlr.PortFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "4242\n" {
+		t.Errorf("got port file %q", b)
+	}
+	if !s.pfPublished {
+		t.Error("port not marked published after a bind worked")
+	}
+}
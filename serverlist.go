@@ -0,0 +1,58 @@
+package piad
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.jonnrb.io/piad/session"
+)
+
+const (
+	serverListCacheFile       = "serverlist.json"
+	serverListRefreshInterval = 6 * time.Hour
+	serverListRetryDelay      = 5 * time.Minute
+)
+
+type serverListUpdate struct {
+	l   session.ServerList
+	err error
+}
+
+// Keeps the server list (and the cache of it) fresh while the tunnel is up.
+// Fetching happens in the background and the result is picked up on a later
+// call.
+func (s *controllerState) refreshServerList(ctx context.Context) {
+	select {
+	case u := <-s.serverListUpdates:
+		s.applyServerListUpdate(u)
+	default:
+	}
+
+	if s.nextServerListRefresh.IsZero() || time.Now().Before(s.nextServerListRefresh) {
+		return
+	}
+	// Zero until the fetch finishes so only one runs at a time.
+	s.nextServerListRefresh = time.Time{}
+
+	cli := s.cli
+	go func() {
+		l, err := session.GetServers(ctx, cli)
+		s.serverListUpdates <- serverListUpdate{l, err}
+	}()
+}
+
+func (s *controllerState) applyServerListUpdate(u serverListUpdate) {
+	// A stale list (see api.StaleError) is no better than the one we have.
+	if u.err != nil {
+		log.Printf("error refreshing server list: %v", u.err)
+		s.nextServerListRefresh = time.Now().Add(serverListRetryDelay)
+		return
+	}
+	s.nextServerListRefresh = time.Now().Add(serverListRefreshInterval)
+
+	s.serverList = u.l
+	if r, ok := u.l[s.region.DNS]; ok && len(r.Servers) != 0 {
+		s.region = r
+	}
+}
@@ -2,8 +2,8 @@ package session
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -27,12 +27,43 @@ type Session struct {
 	DNSServers []net.IP  `json:"dns_servers"`
 }
 
-func (s Server) AddKey(ctx context.Context, username, password string, key PublicKey) (sn Session, err error) {
-	tok, err := api.GetToken(ctx, username, password)
+// Returned by AddKey when it couldn't get a token to add the key with, which
+// says nothing about the server.
+type TokenError struct {
+	Err error
+}
+
+func (e *TokenError) Error() string {
+	return fmt.Sprintf("error getting token: %v", e.Err)
+}
+
+func (e *TokenError) Unwrap() error {
+	return e.Err
+}
+
+func (s Server) AddKey(ctx context.Context, cli *api.Client, tokens *api.TokenCache, key PublicKey) (sn Session, err error) {
+	tok, err := tokens.Token(ctx)
 	if err != nil {
+		err = &TokenError{err}
 		return
 	}
 
+	sn, err = s.addKey(ctx, cli, tok, key)
+	if errors.Is(err, api.ErrAuth) {
+		// The cached token may have been revoked; try once more with a fresh
+		// one.
+		tokens.Invalidate(tok)
+		tok, err = tokens.Token(ctx)
+		if err != nil {
+			err = &TokenError{err}
+			return
+		}
+		sn, err = s.addKey(ctx, cli, tok, key)
+	}
+	return
+}
+
+func (s Server) addKey(ctx context.Context, cli *api.Client, tok api.Token, key PublicKey) (sn Session, err error) {
 	u := url.URL{
 		Scheme: "https",
 		Host:   s.Addr.String(),
@@ -43,27 +74,19 @@ func (s Server) AddKey(ctx context.Context, username, password string, key Publi
 		}.Encode(),
 	}
 	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
-	req.Host = s.CommonName
-
-	cli := http.Client{
-		Transport: &http.Transport{
-			DialTLS: func(network, addr string) (net.Conn, error) {
-				return tls.Dial(network, addr, &tls.Config{
-					RootCAs:    certPool,
-					ServerName: s.CommonName,
-				})
-			},
-		},
+	if err != nil {
+		return
 	}
+	req.Host = s.CommonName
 
-	res, err := cli.Do(req)
+	res, err := s.httpClient(cli).Do(req)
 	if err != nil {
 		return
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusOK {
-		err = StatusError(res.StatusCode)
+	err = api.CheckResponse(res)
+	if err != nil {
 		return
 	}
 
@@ -78,9 +101,3 @@ func (s Server) AddKey(ctx context.Context, username, password string, key Publi
 	}
 	return
 }
-
-type StatusError int
-
-func (e StatusError) Error() string {
-	return fmt.Sprintf("HTTP error %d", e)
-}
@@ -0,0 +1,117 @@
+package session
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.jonnrb.io/piad/api"
+)
+
+func TestAddKey(t *testing.T) {
+	logins := 0
+	tokSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logins++
+		fmt.Fprintf(w, `{"token":"tok%d"}`, logins)
+	}))
+	defer tokSrv.Close()
+
+	serverSK, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotTokens []string
+	wgSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/addKey" || q.Get("pubkey") != sk.PublicKey().String() {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		gotTokens = append(gotTokens, q.Get("pt"))
+		if q.Get("pt") == "tok1" {
+			// As if the first token had been revoked.
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{
+			"status": "OK",
+			"server_key": %q,
+			"server_port": 1337,
+			"server_ip": "192.0.2.1",
+			"server_vip": "10.0.0.1",
+			"peer_ip": "10.0.0.2/32",
+			"dns_servers": ["10.0.0.243"]
+		}`, serverSK.PublicKey().String())
+	}))
+	defer wgSrv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(wgSrv.Certificate())
+	cli := &api.Client{
+		TokenEndpoint: tokSrv.URL,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		},
+	}
+	tokens := &api.TokenCache{Client: cli, Username: "user", Password: "pass"}
+	// httptest's cert is good for example.com.
+	srv := Server{
+		Addr:       *wgSrv.Listener.Addr().(*net.TCPAddr),
+		CommonName: "example.com",
+	}
+
+	sn, err := srv.AddKey(context.Background(), cli, tokens, sk.PublicKey())
+	if err != nil {
+		t.Fatalf("AddKey: %v", err)
+	}
+
+	if len(gotTokens) != 2 || gotTokens[0] != "tok1" || gotTokens[1] != "tok2" {
+		t.Errorf("server saw tokens %q, want a retry with a fresh one", gotTokens)
+	}
+	if sn.ServerKey != serverSK.PublicKey() {
+		t.Errorf("got server key %v, want %v", sn.ServerKey, serverSK.PublicKey())
+	}
+	if want := "192.0.2.1:1337"; sn.ServerAddr.String() != want {
+		t.Errorf("got server addr %v, want %v", &sn.ServerAddr, want)
+	}
+	if !sn.PeerIP.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("got peer IP %v, want 10.0.0.2", sn.PeerIP)
+	}
+	if len(sn.DNSServers) != 1 || !sn.DNSServers[0].Equal(net.ParseIP("10.0.0.243")) {
+		t.Errorf("got DNS servers %v, want [10.0.0.243]", sn.DNSServers)
+	}
+}
+
+func TestAddKeyTokenError(t *testing.T) {
+	tokSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer tokSrv.Close()
+
+	cli := &api.Client{TokenEndpoint: tokSrv.URL}
+	tokens := &api.TokenCache{Client: cli, Username: "user", Password: "pass"}
+	// Nothing listens here; the server shouldn't be contacted anyway.
+	srv := Server{Addr: net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}}
+
+	sk, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = srv.AddKey(context.Background(), cli, tokens, sk.PublicKey())
+
+	var tokErr *TokenError
+	if !errors.As(err, &tokErr) || !errors.Is(err, api.ErrRateLimited) {
+		t.Errorf("got %v, want a *TokenError wrapping ErrRateLimited", err)
+	}
+}
@@ -22,3 +22,21 @@ func (pk *PublicKey) UnmarshalText(text []byte) (err error) {
 	*pk = PublicKey(wk)
 	return
 }
+
+func (sk SecretKey) MarshalText() ([]byte, error) {
+	return []byte(wgtypes.Key(sk).String()), nil
+}
+
+func (sk *SecretKey) UnmarshalText(text []byte) (err error) {
+	wk, err := wgtypes.ParseKey(string(text))
+	*sk = SecretKey(wk)
+	return
+}
+
+func (pk PublicKey) MarshalText() ([]byte, error) {
+	return []byte(wgtypes.Key(pk).String()), nil
+}
+
+func (pk PublicKey) String() string {
+	return wgtypes.Key(pk).String()
+}
@@ -0,0 +1,124 @@
+package session
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.jonnrb.io/piad/api"
+)
+
+// The port forwarding API is served on the server VIP, so it is only reachable
+// through the tunnel (i.e. not with marked sockets).
+const portForwardAPIPort = 19999
+
+// How often a forwarded port must be re-bound to keep it.
+const BindPortInterval = 15 * time.Minute
+
+type PortForward struct {
+	Port      uint16
+	ExpiresAt time.Time
+
+	// Opaque values handed back to /bindPort.
+	Payload   string
+	Signature string
+}
+
+type signatureResponse struct {
+	Status    string `json:"status"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type signaturePayload struct {
+	Port      uint16    `json:"port"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type bindPortResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// Asks the server for a forwarded port, which stays assigned until
+// pf.ExpiresAt as long as it is bound every BindPortInterval.
+func (s Server) GetSignature(ctx context.Context, cli *api.Client, tok api.Token, sn Session) (pf PortForward, err error) {
+	var sres signatureResponse
+	err = s.getPortForwardAPI(ctx, cli, sn, "getSignature", url.Values{
+		"token": []string{string(tok)},
+	}, &sres)
+	if err != nil {
+		return
+	}
+	if sres.Status != "OK" {
+		err = fmt.Errorf("error from /getSignature: %s", sres.Status)
+		return
+	}
+
+	b, err := base64.StdEncoding.DecodeString(sres.Payload)
+	if err != nil {
+		err = fmt.Errorf("error decoding signature payload: %w", err)
+		return
+	}
+	var p signaturePayload
+	err = json.Unmarshal(b, &p)
+	if err != nil {
+		err = fmt.Errorf("error decoding signature payload: %w", err)
+		return
+	}
+
+	pf = PortForward{
+		Port:      p.Port,
+		ExpiresAt: p.ExpiresAt,
+		Payload:   sres.Payload,
+		Signature: sres.Signature,
+	}
+	return
+}
+
+func (s Server) BindPort(ctx context.Context, cli *api.Client, sn Session, pf PortForward) error {
+	var bres bindPortResponse
+	err := s.getPortForwardAPI(ctx, cli, sn, "bindPort", url.Values{
+		"payload":   []string{pf.Payload},
+		"signature": []string{pf.Signature},
+	}, &bres)
+	if err != nil {
+		return err
+	}
+	if bres.Status != "OK" {
+		return fmt.Errorf("error from /bindPort: %s: %s", bres.Status, bres.Message)
+	}
+	return nil
+}
+
+func (s Server) getPortForwardAPI(ctx context.Context, cli *api.Client, sn Session, path string, q url.Values, v interface{}) error {
+	u := url.URL{
+		Scheme:   "https",
+		Host:     net.JoinHostPort(sn.ServerVIP.String(), strconv.Itoa(portForwardAPIPort)),
+		Path:     path,
+		RawQuery: q.Encode(),
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = s.CommonName
+
+	res, err := s.httpClient(cli).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := api.CheckResponse(res); err != nil {
+		return err
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
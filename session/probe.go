@@ -0,0 +1,122 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.jonnrb.io/piad/api"
+)
+
+const probeTimeout = 3 * time.Second
+
+// Measures how long it takes to open a TCP connection to the server's API.
+func (s Server) Probe(ctx context.Context, cli *api.Client) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := cli.DialContext(ctx, "tcp", s.Addr.String())
+	if err != nil {
+		return 0, err
+	}
+	d := time.Since(start)
+	conn.Close()
+	return d, nil
+}
+
+// Probes each of the region's servers and returns the lowest latency.
+func (r Region) Probe(ctx context.Context, cli *api.Client) (best time.Duration, err error) {
+	err = errors.New("region has no servers")
+	for _, srv := range r.Servers {
+		d, perr := srv.Probe(ctx, cli)
+		if perr != nil {
+			if best == 0 {
+				err = perr
+			}
+			continue
+		}
+		if best == 0 || d < best {
+			best, err = d, nil
+		}
+	}
+	return
+}
+
+// Selects which regions are considered for automatic selection.
+type RegionFilter struct {
+	// If not empty, only regions in these countries (e.g. "US") are used.
+	Countries []string
+
+	// Only use regions that support port forwarding.
+	PortForward bool
+
+	// Allow regions that are geolocated (i.e. the servers aren't actually in
+	// the region's country).
+	Geo bool
+}
+
+func (f RegionFilter) Match(r Region) bool {
+	if !r.AutoRegion || len(r.Servers) == 0 {
+		return false
+	}
+	if f.PortForward && !r.PortForward {
+		return false
+	}
+	if r.Geo && !f.Geo {
+		return false
+	}
+	if len(f.Countries) == 0 {
+		return true
+	}
+	for _, c := range f.Countries {
+		if strings.EqualFold(c, r.Country) {
+			return true
+		}
+	}
+	return false
+}
+
+type RegionProbe struct {
+	Region  Region
+	Latency time.Duration
+	Err     error
+}
+
+// Probes the regions matching f concurrently. The results are ordered from
+// lowest to highest latency, followed by the regions that couldn't be
+// reached.
+func (l ServerList) Probe(ctx context.Context, cli *api.Client, f RegionFilter) []RegionProbe {
+	var ps []RegionProbe
+	for _, r := range l {
+		if f.Match(r) {
+			ps = append(ps, RegionProbe{Region: r})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := range ps {
+		wg.Add(1)
+		go func(p *RegionProbe) {
+			defer wg.Done()
+			p.Latency, p.Err = p.Region.Probe(ctx, cli)
+		}(&ps[i])
+	}
+	wg.Wait()
+
+	sort.Slice(ps, func(i, j int) bool {
+		a, b := ps[i], ps[j]
+		switch {
+		case (a.Err == nil) != (b.Err == nil):
+			return a.Err == nil
+		case a.Err == nil && a.Latency != b.Latency:
+			return a.Latency < b.Latency
+		default:
+			return a.Region.DNS < b.Region.DNS
+		}
+	})
+	return ps
+}
@@ -5,20 +5,35 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 
 	"go.jonnrb.io/piad/api"
 )
 
-type ServerList map[string][]Server
+type ServerList map[string]Region
+
+type Region struct {
+	ID          string
+	Name        string
+	Country     string
+	DNS         string
+	AutoRegion  bool
+	PortForward bool
+	Geo         bool
+	Servers     []Server
+}
 
 type Server struct {
 	Addr       net.TCPAddr
 	CommonName string
 }
 
-func GetServers(ctx context.Context) (ServerList, error) {
-	ul, err := api.GetServerList(ctx)
-	if err != nil {
+// Gets the WireGuard servers in each region. Like api.Client.GetServerList,
+// a cached list may be returned along with an *api.StaleError.
+func GetServers(ctx context.Context, cli *api.Client) (ServerList, error) {
+	ul, err := cli.GetServerList(ctx)
+	var stale *api.StaleError
+	if err != nil && !errors.As(err, &stale) {
 		return nil, fmt.Errorf("error getting server list: %w", err)
 	}
 
@@ -61,7 +76,22 @@ func GetServers(ctx context.Context) (ServerList, error) {
 				CommonName: u.CommonName,
 			}
 		}
-		dl[r.DNS] = ds
+		dl[r.DNS] = Region{
+			ID:          r.ID,
+			Name:        r.Name,
+			Country:     r.Country,
+			DNS:         r.DNS,
+			AutoRegion:  r.AutoRegion,
+			PortForward: r.PortForward,
+			Geo:         r.Geo,
+			Servers:     ds,
+		}
 	}
-	return dl, nil
+	return dl, err
+}
+
+// Makes a client for talking to the server's APIs, which present certs for
+// s.CommonName signed by the PIA CA.
+func (s Server) httpClient(cli *api.Client) *http.Client {
+	return cli.ServerHTTPClient(s.CommonName, certPool)
 }
@@ -0,0 +1,142 @@
+package piad
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.jonnrb.io/piad/internal/atomicfile"
+	"go.jonnrb.io/piad/session"
+)
+
+const stateFile = "state.json"
+
+// What's kept in the state dir so that a restart can pick up where the last
+// run left off instead of registering a new key.
+type persistedState struct {
+	SecretKey    session.SecretKey `json:"secret_key"`
+	KeyCreatedAt time.Time         `json:"key_created_at"`
+	KeyRotated   bool              `json:"key_rotated,omitempty"`
+	Region       string            `json:"region"`
+	Server       session.Server    `json:"server"`
+	Session      session.Session   `json:"session"`
+
+	PortForward *session.PortForward `json:"port_forward,omitempty"`
+}
+
+func (c Controller) statePath() string {
+	return filepath.Join(c.StateDir, stateFile)
+}
+
+func (c Controller) loadState() (ps persistedState, ok bool, err error) {
+	if c.StateDir == "" {
+		return
+	}
+
+	b, err := ioutil.ReadFile(c.statePath())
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(b, &ps)
+	ok = err == nil
+	return
+}
+
+func (s *controllerState) saveState() {
+	if s.ctlr.StateDir == "" {
+		return
+	}
+
+	b, err := json.Marshal(persistedState{
+		SecretKey:    s.sk,
+		KeyCreatedAt: s.keyCreatedAt,
+		KeyRotated:   s.keyRotated,
+		Region:       s.region.DNS,
+		Server:       s.srv,
+		Session:      s.sn,
+
+		PortForward: s.pf,
+	})
+	if err == nil {
+		err = atomicfile.WriteFile(s.ctlr.statePath(), b, 0600)
+	}
+	if err != nil {
+		log.Printf("error saving state: %v", err)
+	}
+}
+
+// Reuses the key from a previous run. If the previous session is for a server
+// we'd use anyway, it's kept too, and if the link is still set up for it and
+// handshaking, the link is adopted as-is and adding the key is skipped.
+func (s *controllerState) restoreState(ps persistedState) error {
+	s.sk = ps.SecretKey
+	s.pk = ps.SecretKey.PublicKey()
+	s.keyCreatedAt = ps.KeyCreatedAt
+	s.keyRotated = ps.KeyRotated
+	if s.keyCreatedAt.IsZero() {
+		s.keyCreatedAt = time.Now()
+	}
+
+	if !s.useServer(ps.Region, ps.Server) {
+		return nil
+	}
+	s.sn = ps.Session
+	s.isRefresh = true
+
+	ok, err := s.l.CanAdopt(s.ctlr.LinkConfig, s.sk, s.sn)
+	if err != nil {
+		return fmt.Errorf("could not inspect link %q: %w", string(s.l), err)
+	}
+	if !ok {
+		return nil
+	}
+
+	t, err := s.l.LastHandshake(s.ctlr.LinkConfig)
+	if err != nil {
+		return nil
+	}
+	s.lastHandshake = t
+	s.handshake = t
+	if s.keepaliveIntervalsPastHandshakeInterval(2, time.Now()) {
+		return nil
+	}
+
+	log.Printf("adopting link %q (last handshake %v)", string(s.l), t)
+	s.resumed = true
+
+	// Keep the forwarded port too; it just needs to keep being bound.
+	s.pf = ps.PortForward
+	return nil
+}
+
+// Switches to srv in region dns if that's one of the regions we'd use and srv
+// is still one of its servers.
+func (s *controllerState) useServer(dns string, srv session.Server) bool {
+	for i, d := range s.ctlr.Regions {
+		if d != dns {
+			continue
+		}
+		r, err := s.ctlr.usableRegion(s.serverList, dns)
+		if err != nil {
+			return false
+		}
+		for _, rs := range r.Servers {
+			if serverKey(rs) == serverKey(srv) {
+				s.useRegion(i, r, rs, time.Now())
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
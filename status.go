@@ -0,0 +1,123 @@
+package piad
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A snapshot of what the controller is doing, as served by StatusAddr.
+type Status struct {
+	Region     string   `json:"region"`
+	Server     string   `json:"server"`
+	PeerIP     net.IP   `json:"peer_ip"`
+	DNSServers []net.IP `json:"dns_servers"`
+
+	// As reported by the device, so zero until the first handshake with the
+	// current server.
+	LastHandshake time.Time `json:"last_handshake"`
+
+	// Whether the server has handshaked recently enough that the tunnel
+	// should be working. This is worked out when the status is served.
+	Healthy bool `json:"healthy"`
+
+	ForwardedPort uint16 `json:"forwarded_port,omitempty"`
+
+	// Unset until the key has been rotated.
+	LastKeyRotation *time.Time `json:"last_key_rotation,omitempty"`
+
+	// Counts from the DNS forwarder, if DNSListenAddr is set.
+	DNSQueries  uint64 `json:"dns_queries,omitempty"`
+	DNSFailures uint64 `json:"dns_failures,omitempty"`
+}
+
+type statusHolder struct {
+	mu     sync.Mutex
+	status Status
+}
+
+func (h *statusHolder) set(st Status) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status = st
+}
+
+// Returns the last status set, with Healthy brought up to date. The controller
+// only sets it between handshake checks, and those can be held up (e.g. by a
+// slow failover).
+func (h *statusHolder) get() Status {
+	h.mu.Lock()
+	st := h.status
+	h.mu.Unlock()
+
+	st.Healthy = isHealthy(st.LastHandshake, time.Now())
+	return st
+}
+
+func (h *statusHolder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.get())
+}
+
+func (s *controllerState) healthy(now time.Time) bool {
+	return isHealthy(s.handshake, now)
+}
+
+func isHealthy(lastHandshake, now time.Time) bool {
+	return !keepaliveIntervalsPastHandshakeInterval(lastHandshake, 2, now)
+}
+
+func (s *controllerState) publishStatus() {
+	st := Status{
+		Region:        s.region.DNS,
+		Server:        s.srv.CommonName,
+		PeerIP:        s.sn.PeerIP,
+		DNSServers:    s.sn.DNSServers,
+		LastHandshake: s.handshake,
+	}
+	if s.keyRotated {
+		t := s.keyCreatedAt
+		st.LastKeyRotation = &t
+	}
+	if s.ctlr.DNSListenAddr != "" {
+		dst := s.fwd.Stats()
+		st.DNSQueries = dst.Queries
+		st.DNSFailures = dst.Failures
+	}
+	if s.pf != nil && s.pfPublished {
+		st.ForwardedPort = s.pf.Port
+	}
+	s.status.set(st)
+}
+
+// Serves the status on StatusAddr (if set) until ctx is done.
+func (s *controllerState) serveStatus(ctx context.Context) error {
+	if s.ctlr.StatusAddr == "" {
+		return nil
+	}
+
+	lis, err := net.Listen("tcp", s.ctlr.StatusAddr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/status", s.status)
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		err := srv.Serve(lis)
+		if err != http.ErrServerClosed {
+			log.Printf("status server exited: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,54 @@
+package piad
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusHealthIsCurrent(t *testing.T) {
+	h := &statusHolder{}
+	h.set(Status{LastHandshake: time.Now()})
+
+	serve := func() (st Status, body string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+		body = rec.Body.String()
+		if err := json.Unmarshal([]byte(body), &st); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	st, body := serve()
+	if !st.Healthy {
+		t.Error("not healthy right after a handshake")
+	}
+	if strings.Contains(body, "last_key_rotation") {
+		t.Errorf("status %s has a key rotation before any happened", body)
+	}
+
+	// As if the controller had been stuck since a handshake long ago.
+	h.set(Status{LastHandshake: time.Now().Add(-time.Hour)})
+	if st, _ := serve(); st.Healthy {
+		t.Error("healthy an hour after the last handshake")
+	}
+}
+
+func TestStatusNotHealthyBeforeHandshake(t *testing.T) {
+	// Right after connecting, the watchdog assumes a handshake but the
+	// device hasn't had one.
+	s := &controllerState{status: &statusHolder{}, lastHandshake: time.Now()}
+	s.publishStatus()
+	if st := s.status.get(); st.Healthy || !st.LastHandshake.IsZero() {
+		t.Errorf("got %+v before the first handshake", st)
+	}
+
+	s.handshake = time.Now()
+	s.publishStatus()
+	if st := s.status.get(); !st.Healthy || !st.LastHandshake.Equal(s.handshake) {
+		t.Errorf("got %+v after a handshake", st)
+	}
+}